@@ -0,0 +1,324 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Multipart fields the files of a message and a recorded voice message are
+// sent in
+const (
+	attachmentFormField = "attachments"
+	voiceFormField      = "voice"
+)
+
+// Attachment limits, read from the environment on first use
+var attachmentLimits = sync.OnceValue(utils.LoadAttachmentLimits)
+
+// attachmentUpload is a validated file waiting to be stored
+type attachmentUpload struct {
+	attachment models.Attachment
+	data       []byte
+}
+
+// attachmentError is a problem with the uploaded files the client can fix
+type attachmentError struct {
+	status  int
+	message string
+}
+
+func (e *attachmentError) Error() string {
+	return e.message
+}
+
+// DownloadAttachment streams an attachment to a participant of its chat
+func DownloadAttachment(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	attachmentID, err := strconv.Atoi(c.Params("attachmentId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid attachment ID",
+		})
+	}
+
+	var attachment models.Attachment
+	if err := database.DB.First(&attachment, attachmentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Attachment not found",
+			})
+		}
+		log.Println("Error fetching attachment:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	// Someone who cannot see the message must not learn the attachment exists
+	if _, err := loadMessageForUser(attachment.MessageID, claims.ID); err != nil {
+		if errors.Is(err, errMessageNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Attachment not found",
+			})
+		}
+		log.Println("Error fetching message:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	file, err := utils.MediaStorage.Open(c.Context(), attachment.StorageKey)
+	if err != nil {
+		log.Println("Error opening attachment:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load attachment",
+		})
+	}
+
+	disposition := "attachment"
+	if utils.InlineContentType(attachment.ContentType) && c.Query("download") == "" {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentType, attachment.ContentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("%s; filename*=UTF-8''%s",
+		disposition, url.PathEscape(attachment.Name)))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; sandbox")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	c.Set(fiber.HeaderETag, `"`+attachment.Checksum+`"`)
+	// The body stream is closed once it has been sent
+	return c.SendStream(file, int(attachment.Size))
+}
+
+// readAttachments validates the files of a multipart message. Requests that
+// are not multipart carry no attachments.
+func readAttachments(c *fiber.Ctx) ([]attachmentUpload, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return nil, nil
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, &attachmentError{fiber.StatusBadRequest, "Invalid multipart form"}
+	}
+
+	limits := attachmentLimits()
+	files := form.File[attachmentFormField]
+	voice := form.File[voiceFormField]
+	if len(voice) > 1 {
+		return nil, &attachmentError{fiber.StatusBadRequest,
+			"Only one voice message can be sent with a message"}
+	}
+	if len(files)+len(voice) > limits.MaxCount {
+		return nil, &attachmentError{fiber.StatusBadRequest,
+			fmt.Sprintf("At most %d attachments can be sent with a message", limits.MaxCount)}
+	}
+
+	var total int64
+	uploads := make([]attachmentUpload, 0, len(files)+len(voice))
+	for i, fileHeader := range append(files, voice...) {
+		if fileHeader.Size > limits.MaxSize {
+			return nil, &attachmentError{fiber.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Attachments must be at most %d MB", limits.MaxSize>>20)}
+		}
+		total += fileHeader.Size
+		if total > limits.MaxTotalSize {
+			return nil, &attachmentError{fiber.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Attachments must be at most %d MB in total", limits.MaxTotalSize>>20)}
+		}
+
+		read := readAttachment
+		if i >= len(files) {
+			read = readVoiceMessage
+		}
+		upload, err := read(fileHeader)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// readAttachment reads one uploaded file and checks its content type.
+// Images are re-encoded, which strips their metadata such as GPS positions.
+func readAttachment(fileHeader *multipart.FileHeader) (attachmentUpload, error) {
+	data, _, err := utils.ReadFormFile(fileHeader)
+	if err != nil {
+		return attachmentUpload{}, err
+	}
+	if len(data) == 0 {
+		return attachmentUpload{}, &attachmentError{fiber.StatusBadRequest, "Attachments cannot be empty"}
+	}
+
+	name := utils.SanitizeFileName(fileHeader.Filename)
+	contentType := utils.AttachmentContentType(name, data)
+	if !attachmentLimits().Allows(contentType) {
+		return attachmentUpload{}, &attachmentError{fiber.StatusUnsupportedMediaType,
+			fmt.Sprintf("Files of type %s cannot be attached", contentType)}
+	}
+
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		cleaned, err := utils.CleanImage(data)
+		if errors.Is(err, utils.ErrInvalidImage) {
+			return attachmentUpload{}, &attachmentError{fiber.StatusUnsupportedMediaType,
+				"Image attachments must be valid images of a supported size"}
+		}
+		if err != nil {
+			return attachmentUpload{}, err
+		}
+		// WebP is re-encoded as PNG or JPEG; the name follows
+		if cleaned.ContentType != contentType {
+			name = strings.TrimSuffix(name, path.Ext(name)) +
+				utils.ExtensionForContentType(cleaned.ContentType)
+		}
+		data, contentType = cleaned.Data, cleaned.ContentType
+	}
+
+	checksum := sha256.Sum256(data)
+	return attachmentUpload{
+		attachment: models.Attachment{
+			Name:        name,
+			Size:        int64(len(data)),
+			ContentType: contentType,
+			Kind:        models.AttachmentKindFile,
+			Checksum:    hex.EncodeToString(checksum[:]),
+		},
+		data: data,
+	}, nil
+}
+
+// readVoiceMessage reads a recorded voice message, checking its container,
+// codec and length, and measures its duration and waveform
+func readVoiceMessage(fileHeader *multipart.FileHeader) (attachmentUpload, error) {
+	data, _, err := utils.ReadFormFile(fileHeader)
+	if err != nil {
+		return attachmentUpload{}, err
+	}
+
+	clip, err := utils.ProbeVoiceClip(data)
+	if err != nil {
+		return attachmentUpload{}, &attachmentError{fiber.StatusUnsupportedMediaType,
+			"Voice messages must be Opus audio in Ogg or WebM, or PCM WAV"}
+	}
+	if maxDuration := attachmentLimits().MaxVoiceDuration; clip.Duration > maxDuration {
+		return attachmentUpload{}, &attachmentError{fiber.StatusBadRequest,
+			fmt.Sprintf("Voice messages can be at most %s long", maxDuration)}
+	}
+
+	name := utils.SanitizeFileName(fileHeader.Filename)
+	if name == "file" || name == "blob" {
+		name = "voice-message" + utils.ExtensionForContentType(clip.ContentType)
+	}
+
+	checksum := sha256.Sum256(data)
+	return attachmentUpload{
+		attachment: models.Attachment{
+			Name:        name,
+			Size:        int64(len(data)),
+			ContentType: clip.ContentType,
+			Kind:        models.AttachmentKindAudio,
+			Checksum:    hex.EncodeToString(checksum[:]),
+			DurationMs:  int(clip.Duration.Milliseconds()),
+			Waveform:    clip.Waveform,
+		},
+		data: data,
+	}, nil
+}
+
+// attachmentUploadError turns a readAttachments error into a response
+func attachmentUploadError(c *fiber.Ctx, err error) error {
+	var uploadErr *attachmentError
+	if errors.As(err, &uploadErr) {
+		return c.Status(uploadErr.status).JSON(fiber.Map{
+			"error": uploadErr.message,
+		})
+	}
+	log.Println("Error reading attachments:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to read the uploaded files",
+	})
+}
+
+// storeAttachments puts the files in media storage. On failure the files
+// already stored are removed again.
+func storeAttachments(ctx context.Context, uploads []attachmentUpload) ([]models.Attachment, error) {
+	attachments := make([]models.Attachment, 0, len(uploads))
+	for _, upload := range uploads {
+		attachment := upload.attachment
+		attachment.StorageKey = utils.NewStorageKey("attachments",
+			utils.ExtensionForContentType(attachment.ContentType))
+		if _, err := utils.MediaStorage.Put(ctx, attachment.StorageKey,
+			attachment.ContentType, upload.data); err != nil {
+			deleteStoredAttachments(ctx, attachments)
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// deleteStoredAttachments removes the files of attachments from media storage
+func deleteStoredAttachments(ctx context.Context, attachments []models.Attachment) {
+	for _, attachment := range attachments {
+		if err := utils.MediaStorage.Delete(ctx, attachment.StorageKey); err != nil {
+			log.Println("Error deleting attachment file:", err)
+		}
+	}
+}
+
+// attachAttachments fills in the attachments of the messages
+func attachAttachments(messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	var attachments []models.Attachment
+	if err := database.DB.Where("message_id IN ?", ids).
+		Order("id ASC").Find(&attachments).Error; err != nil {
+		return err
+	}
+
+	byMessage := make(map[uint][]models.Attachment)
+	for _, attachment := range attachments {
+		attachment.URL = attachmentURL(attachment.ID)
+		byMessage[attachment.MessageID] = append(byMessage[attachment.MessageID], attachment)
+	}
+	for i := range messages {
+		messages[i].Attachments = byMessage[messages[i].ID]
+	}
+	return nil
+}
+
+// attachmentURL is the API path an attachment is downloaded from
+func attachmentURL(id uint) string {
+	return "/api/attachments/" + strconv.FormatUint(uint64(id), 10)
+}
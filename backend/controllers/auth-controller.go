@@ -2,11 +2,10 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strings"
-	"time"
+	"net/mail"
 
 	"github.com/chat-app/database"
 	"github.com/chat-app/models"
@@ -40,22 +39,24 @@ func SignupHandler(c *fiber.Ctx) error {
 	}
 
 	// Validate email format
-	if !strings.Contains(user.Email, "@") {
+	if address, err := mail.ParseAddress(user.Email); err != nil ||
+		address.Address != user.Email {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "email is incorrect",
 		})
 	}
 
 	// Validate password length
-	if len(user.Password) < 6 {
+	if len(user.Password) < minPasswordLength {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "password should be at least 6 characters",
+			"error": fmt.Sprintf("password should be at least %d characters", minPasswordLength),
 		})
 	}
 
-	// Check if user email already exists in the database
+	// Check if user email already exists in the database. Logins match
+	// addresses regardless of case, so accounts must differ by more.
 	var existingUser models.User
-	if err := database.DB.Where("email = ?", user.Email).First(
+	if err := database.DB.Where("LOWER(email) = ?", normalizeEmail(user.Email)).First(
 		&existingUser).Error; err == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "email already in use",
@@ -85,8 +86,13 @@ func SignupHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate the JWT Token
-	token, err := utils.CreateJWT(c, newUser.ID, newUser.FullName)
+	// Accounts start unverified; a failed email can be resent later
+	if err := sendVerificationEmail(newUser); err != nil {
+		log.Println("Error sending verification email:", err)
+	}
+
+	// Start a session and generate the JWT Token
+	token, err := utils.StartSession(c, newUser)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to generate token",
@@ -96,37 +102,30 @@ func SignupHandler(c *fiber.Ctx) error {
 	// Return success response with token
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"user": fiber.Map{
-			"id":         newUser.ID,
-			"fullname":   newUser.FullName,
-			"email":      newUser.Email,
-			"created_at": newUser.CreatedAt,
-			"updated_at": newUser.UpdatedAt,
+			"id":            newUser.ID,
+			"fullname":      newUser.FullName,
+			"email":         newUser.Email,
+			"emailVerified": false,
+			"created_at":    newUser.CreatedAt,
+			"updated_at":    newUser.UpdatedAt,
 		},
 		"token": token,
 	})
 }
 
 func LogoutHandler(c *fiber.Ctx) error {
-	// Validate cookie name
-	if utils.CookieName == "" {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"message": "server misconfiguration: cookie name is not set",
-		})
+	// Revoke the session behind this device, found through the refresh
+	// cookie or, failing that, the access token
+	if session, err := utils.SessionFromRefreshCookie(c); err == nil {
+		utils.RevokeSession(session.UserID, session.ID)
+	} else if claims, err := utils.ValidateToken(c.Cookies(utils.CookieName)); err == nil {
+		userID, _ := claims["id"].(float64)
+		sessionID, _ := claims["sid"].(float64)
+		utils.RevokeSession(uint(userID), uint(sessionID))
 	}
 
-	// Determine cookie security based on environment
-	isProduction := os.Getenv("ENV_KEY") == "production"
-
-	// Clear the auth_token cookie by setting its expiry in the past
-	c.Cookie(&fiber.Cookie{
-		Name:     utils.CookieName,                // Name of the authentication cookie
-		Value:    "",                              // Empty value to clear the cookie
-		Expires:  time.Now().Add(-24 * time.Hour), // Set expiration in the past to clear the cookie
-		HTTPOnly: true,                            // Ensure the cookie cannot be accessed via JavaScript
-		Secure:   isProduction,                    // Set to `true` if running on HTTPS
-		SameSite: fiber.CookieSameSiteStrictMode,  // SameSite policy for added security
-	})
+	// Clear the auth cookies by setting their expiry in the past
+	utils.ClearAuthCookies(c)
 
 	// Return a success response
 	if err := c.Status(fiber.StatusAccepted).JSON(fiber.Map{
@@ -165,26 +164,68 @@ func LoginHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	// Fetch the user by email from the database
-	var existingUser models.User
-	if err := database.DB.Where("email = ?", user.Email).First(
-		&existingUser).Error; err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid email or password",
+	// Repeated failures lock the account and the client IP out for a while
+	email := normalizeEmail(user.Email)
+	wait, err := loginLockout(email, c.IP())
+	if err != nil {
+		log.Println("Error checking login lockout:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "internal server error",
 		})
 	}
+	if wait > 0 {
+		recordLoginAttempt(c, email, nil, models.LoginReasonLocked)
+		return loginLockedResponse(c, wait)
+	}
+
+	// Unknown emails and wrong passwords get the same answer, so the
+	// response does not reveal which accounts exist
+	invalidCredentials := fiber.Map{"error": "invalid email or password"}
+
+	// Fetch the user by the same normalized email the failures are counted
+	// under, so every spelling of an address is throttled and found alike.
+	// Bots never log in.
+	var existingUser models.User
+	if err := database.DB.Where("LOWER(email) = ? AND type <> ?", email,
+		models.UserTypeBot).Order("id").First(&existingUser).Error; err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(user.Password))
+		recordLoginAttempt(c, email, nil, models.LoginReasonUnknownEmail)
+		return c.Status(fiber.StatusBadRequest).JSON(invalidCredentials)
+	}
 
 	// Check Password
 	err = bcrypt.CompareHashAndPassword([]byte(existingUser.Password),
 		[]byte(user.Password))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "please enter the correct password",
+		recordLoginAttempt(c, email, &existingUser.ID, models.LoginReasonWrongPassword)
+		return c.Status(fiber.StatusBadRequest).JSON(invalidCredentials)
+	}
+
+	// With two-factor authentication the session only starts once the
+	// code is verified; hand out a challenge token for that second step
+	if existingUser.TwoFactorEnabled {
+		challengeToken, err := utils.CreateChallengeToken(existingUser.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "could not create login challenge",
+			})
+		}
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"twoFactorRequired": true,
+			"challengeToken":    challengeToken,
 		})
 	}
 
-	// Generate the JWT Token
-	token, err := utils.CreateJWT(c, existingUser.ID, existingUser.FullName)
+	return completeLogin(c, existingUser)
+}
+
+// completeLogin starts a session for an authenticated user and responds
+// with their data and the JWT token
+func completeLogin(c *fiber.Ctx, user models.User) error {
+	recordLoginAttempt(c, normalizeEmail(user.Email), &user.ID, models.LoginReasonSuccess)
+
+	// Start a session and generate the JWT Token
+	token, err := utils.StartSession(c, user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "could not create JWT token",
@@ -194,11 +235,12 @@ func LoginHandler(c *fiber.Ctx) error {
 	// Respond with user data and the JWT token
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"user": fiber.Map{
-			"id":         existingUser.ID,
-			"fullname":   existingUser.FullName,
-			"email":      existingUser.Email,
-			"created_at": existingUser.CreatedAt,
-			"updated_at": existingUser.UpdatedAt,
+			"id":            user.ID,
+			"fullname":      user.FullName,
+			"email":         user.Email,
+			"emailVerified": user.EmailVerifiedAt != nil,
+			"created_at":    user.CreatedAt,
+			"updated_at":    user.UpdatedAt,
 		},
 		"token": token, // Send the token in the response as well (optional)
 	})
@@ -228,10 +270,14 @@ func SignedInUser(c *fiber.Ctx) error {
 	// Return user information (extend if needed)
 	return c.JSON(fiber.Map{
 		"user": fiber.Map{
-			"id":         user.ID,
-			"fullname":   user.FullName,
-			"email":      user.Email,
-			"profilePic": user.ProfilePic,
+			"id":                  user.ID,
+			"fullname":            user.FullName,
+			"email":               user.Email,
+			"emailVerified":       user.EmailVerifiedAt != nil,
+			"twoFactorEnabled":    user.TwoFactorEnabled,
+			"profilePic":          user.ProfilePic,
+			"profilePicPreview":   user.ProfilePicPreview,
+			"profilePicThumbnail": user.ProfilePicThumbnail,
 		},
 		"token": token,
 	})
@@ -257,48 +303,43 @@ func UpdateProfile(c *fiber.Ctx) error {
 		})
 	}
 
-	// Initialize Cloudinary service
-	cloudService, err := utils.NewCloudinaryService()
-	if err != nil {
-		log.Println("Error initializing Cloudinary service:", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Unable to connect to cloud service",
-		})
-	}
-
 	ctx := context.Background()
 
 	// Handle profile picture upload
-	var uploadedURL string
+	var uploaded utils.StoredImage
 	if profilePic, err := c.FormFile("profilePic"); err == nil {
-		// Delete the old profile picture if it exists
-		if user.ProfilePic != "" {
-			publicID := extractPublicID(user.ProfilePic)
-			if err := cloudService.DeleteImage(ctx, publicID); err != nil {
-				log.Println("Warning: Failed to delete old profile image:", err)
-			}
-		}
-
-		// Save the uploaded file locally
-		filePath := fmt.Sprintf("./uploads/%s", profilePic.Filename)
-		if err := c.SaveFile(profilePic, filePath); err != nil {
+		data, _, err := utils.ReadFormFile(profilePic)
+		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to save the uploaded file",
+				"error": "Failed to read the uploaded file",
 			})
 		}
 
-		// Upload the image to Cloudinary
-		uploadedURL, err = cloudService.UploadImage(ctx, filePath)
+		// The pipeline decodes the content, so only real images get through,
+		// and stores the picture without its metadata plus smaller sizes
+		uploaded, err = utils.StoreImage(ctx, "profile-pics", data)
+		if errors.Is(err, utils.ErrInvalidImage) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Profile picture must be an image",
+			})
+		}
 		if err != nil {
+			log.Println("Error uploading profile image:", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Failed to upload profile image",
 			})
 		}
+
+		// Delete the old profile picture if it exists
+		utils.DeleteStoredImage(ctx, user.ProfilePic, user.ProfilePicPreview,
+			user.ProfilePicThumbnail)
 	}
 
 	// Update the user's profile picture in the database
 	if err := database.DB.Model(&user).Updates(models.User{
-		ProfilePic: uploadedURL,
+		ProfilePic:          uploaded.URL,
+		ProfilePicPreview:   uploaded.PreviewURL,
+		ProfilePicThumbnail: uploaded.ThumbnailURL,
 	}).Error; err != nil {
 		log.Println("Error updating user profile:", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -313,16 +354,8 @@ func UpdateProfile(c *fiber.Ctx) error {
 	})
 }
 
-// Helper function to extract public ID from a Cloudinary URL
-func extractPublicID(url string) string {
-	// Assuming URL format: https://res.cloudinary.com/<cloud-name>/image/upload/v1234567890/folder/publicID.extension
-	// Step 1: Split the URL into parts using "/" as the separator
-	parts := strings.Split(url, "/")
-	// Step 2: Get the last part of the URL, which contains
-	// "publicID.extension"
-	lastPart := parts[len(parts)-1]
-	// Step 3: Split "my-image-name.extension" using "." to separate
-	// the public ID from the file extension
-	publicID := strings.Split(lastPart, ".")[0]
-	return publicID
+// GetJWKS publishes the keys access tokens can be verified with
+func GetJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(utils.AuthTokens.JWKS())
 }
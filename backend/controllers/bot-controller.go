@@ -0,0 +1,371 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Scopes of the tokens bots act with
+var botTokenScopes = []string{models.ScopeMessagesRead, models.ScopeMessagesWrite}
+
+var errBotNotFound = errors.New("bot not found")
+
+// CreateBot creates a bot account owned by the caller and returns its first
+// access token. The token is only shown this once.
+func CreateBot(c *fiber.Ctx) error {
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxTokenNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Bot name is required and must be at most 100 characters",
+		})
+	}
+
+	bot, err := newBotUser(req.Name, claims.ID)
+	if err != nil {
+		log.Println("Error preparing bot:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create bot",
+		})
+	}
+	if err := database.DB.Create(&bot).Error; err != nil {
+		log.Println("Error creating bot:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create bot",
+		})
+	}
+
+	token, _, err := utils.IssuePersonalAccessToken(bot.ID, "bot token", botTokenScopes, nil)
+	if err != nil {
+		log.Println("Error creating bot token:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create bot token",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"bot":   bot,
+		"token": token,
+	})
+}
+
+// GetBots lists the caller's bots
+func GetBots(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	var bots []models.User
+	if err := database.DB.Scopes(selectPublicUserFields).
+		Where("type = ? AND bot_owner_id = ?", models.UserTypeBot, claims.ID).
+		Order("id ASC").Find(&bots).Error; err != nil {
+		log.Println("Error fetching bots:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"bots": bots,
+	})
+}
+
+// RotateBotToken revokes the bot's access tokens and issues a new one
+func RotateBotToken(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	bot, err := loadOwnedBot(c.Params("botId"), claims.ID)
+	if err != nil {
+		return botLookupError(c, err)
+	}
+
+	if err := database.DB.Model(&models.PersonalAccessToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", bot.ID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		log.Println("Error revoking bot tokens:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate bot token",
+		})
+	}
+
+	token, _, err := utils.IssuePersonalAccessToken(bot.ID, "bot token", botTokenScopes, nil)
+	if err != nil {
+		log.Println("Error creating bot token:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate bot token",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"token": token,
+	})
+}
+
+// CreateBotWebhook registers a URL that receives the messages sent to the
+// bot. The signing secret is only shown this once.
+func CreateBotWebhook(c *fiber.Ctx) error {
+	var req struct {
+		URL string `json:"url"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	bot, err := loadOwnedBot(c.Params("botId"), claims.ID)
+	if err != nil {
+		return botLookupError(c, err)
+	}
+
+	req.URL = strings.TrimSpace(req.URL)
+	if err := utils.ValidateWebhookURL(req.URL); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	secret := "whsec_" + utils.GenerateToken(32)
+	webhook := models.BotWebhook{
+		BotID:  bot.ID,
+		URL:    req.URL,
+		Secret: secret,
+		Active: true,
+	}
+	if err := database.DB.Create(&webhook).Error; err != nil {
+		log.Println("Error creating webhook:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create webhook",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// GetBotWebhooks lists the bot's webhooks
+func GetBotWebhooks(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	bot, err := loadOwnedBot(c.Params("botId"), claims.ID)
+	if err != nil {
+		return botLookupError(c, err)
+	}
+
+	var webhooks []models.BotWebhook
+	if err := database.DB.Where("bot_id = ?", bot.ID).
+		Order("id ASC").Find(&webhooks).Error; err != nil {
+		log.Println("Error fetching webhooks:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"webhooks": webhooks,
+	})
+}
+
+// DeleteBotWebhook removes a webhook. Its pending deliveries are dropped by
+// the delivery worker; the delivery log is kept.
+func DeleteBotWebhook(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	bot, err := loadOwnedBot(c.Params("botId"), claims.ID)
+	if err != nil {
+		return botLookupError(c, err)
+	}
+
+	webhookID, err := strconv.Atoi(c.Params("webhookId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	result := database.DB.Where("id = ? AND bot_id = ?", webhookID, bot.ID).
+		Delete(&models.BotWebhook{})
+	if result.Error != nil {
+		log.Println("Error deleting webhook:", result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete webhook",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Webhook deleted",
+	})
+}
+
+// GetWebhookDeliveries returns a webhook's delivery log, newest first. Pass
+// ?before=<deliveryId> for older entries.
+func GetWebhookDeliveries(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	bot, err := loadOwnedBot(c.Params("botId"), claims.ID)
+	if err != nil {
+		return botLookupError(c, err)
+	}
+
+	webhookID, err := strconv.Atoi(c.Params("webhookId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	page, err := parseCursorPage(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var webhook models.BotWebhook
+	if err := database.DB.Where("id = ? AND bot_id = ?", webhookID, bot.ID).
+		First(&webhook).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	query := database.DB.Where("webhook_id = ?", webhook.ID)
+	if page.Before != 0 {
+		query = query.Where("id < ?", page.Before)
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Limit(page.Limit + 1).
+		Find(&deliveries).Error; err != nil {
+		log.Println("Error fetching webhook deliveries:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	var nextCursor *uint
+	if len(deliveries) > page.Limit {
+		deliveries = deliveries[:page.Limit]
+		nextCursor = ptrTo(deliveries[len(deliveries)-1].ID)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"deliveries": deliveries,
+		"nextCursor": nextCursor,
+	})
+}
+
+// newBotUser builds a bot account. Bots get an unroutable email address and
+// a random password, and cannot log in.
+func newBotUser(name string, ownerID uint) (models.User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(utils.GenerateToken(32)),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	now := time.Now()
+	return models.User{
+		Email:           fmt.Sprintf("bot-%s@bots.invalid", strings.ToLower(utils.GenerateToken(12))),
+		FullName:        name,
+		Password:        string(hashedPassword),
+		Type:            models.UserTypeBot,
+		BotOwnerID:      &ownerID,
+		EmailVerifiedAt: &now,
+	}, nil
+}
+
+// loadOwnedBot fetches a bot owned by the user
+func loadOwnedBot(botIDParam string, ownerID uint) (models.User, error) {
+	var bot models.User
+	botID, err := strconv.Atoi(botIDParam)
+	if err != nil {
+		return bot, errBotNotFound
+	}
+
+	err = database.DB.Scopes(selectPublicUserFields).
+		Where("id = ? AND type = ? AND bot_owner_id = ?", botID, models.UserTypeBot, ownerID).
+		First(&bot).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return bot, errBotNotFound
+	}
+	return bot, err
+}
+
+// botLookupError turns a loadOwnedBot error into a response
+func botLookupError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errBotNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Bot not found",
+		})
+	}
+	log.Println("Error fetching bot:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Internal server error",
+	})
+}
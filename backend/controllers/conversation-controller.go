@@ -0,0 +1,469 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// CreateConversation creates a group conversation owned by the logged-in user
+func CreateConversation(c *fiber.Ctx) error {
+	var req struct {
+		Name      string `json:"name"`
+		MemberIDs []uint `json:"memberIds"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+	userID := claims.ID
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Conversation name is required",
+		})
+	}
+
+	memberIDs, err := existingUserIDs(req.MemberIDs, userID)
+	if err != nil {
+		log.Println("Error checking conversation members:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if len(memberIDs) != len(uniqueIDs(req.MemberIDs, userID)) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "One or more members do not exist",
+		})
+	}
+
+	conversation := models.Conversation{
+		Name:        req.Name,
+		CreatedByID: userID,
+		Members: []models.ConversationMember{
+			{UserID: userID, Role: models.RoleOwner},
+		},
+	}
+	for _, id := range memberIDs {
+		conversation.Members = append(conversation.Members,
+			models.ConversationMember{UserID: id, Role: models.RoleMember})
+	}
+
+	if err := database.DB.Create(&conversation).Error; err != nil {
+		log.Println("Error creating conversation:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create conversation",
+		})
+	}
+
+	// Let every member know about the new group
+	utils.EmitToUsers(memberIDs, fiber.Map{
+		"event":        "conversationCreated",
+		"conversation": conversation,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"conversation": conversation,
+	})
+}
+
+// GetConversations lists the group conversations the logged-in user belongs to
+func GetConversations(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+	userID := claims.ID
+
+	var conversations []models.Conversation
+	err := database.DB.
+		Where("id IN (?)", database.DB.Model(&models.ConversationMember{}).
+			Select("conversation_id").Where("user_id = ?", userID)).
+		Preload("Members", preloadMemberUsers).
+		Preload("Members.User", selectPublicUserFields).
+		Order("updated_at DESC").
+		Find(&conversations).Error
+	if err != nil {
+		log.Println("Error fetching conversations:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"conversations": conversations,
+	})
+}
+
+// GetConversation returns a single group conversation with its members
+func GetConversation(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	conversationID, err := strconv.Atoi(c.Params("conversationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid conversation ID",
+		})
+	}
+
+	if _, err := getMembership(uint(conversationID), claims.ID); err != nil {
+		return membershipError(c, err)
+	}
+
+	conversation, err := loadConversation(uint(conversationID))
+	if err != nil {
+		log.Println("Error fetching conversation:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"conversation": conversation,
+	})
+}
+
+// AddConversationMembers adds users to a group; owners and admins only
+func AddConversationMembers(c *fiber.Ctx) error {
+	var req struct {
+		UserIDs []uint `json:"userIds"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	conversationID, err := strconv.Atoi(c.Params("conversationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid conversation ID",
+		})
+	}
+
+	actor, err := getMembership(uint(conversationID), claims.ID)
+	if err != nil {
+		return membershipError(c, err)
+	}
+	if models.RoleRank(actor.Role) < models.RoleRank(models.RoleAdmin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only owners and admins can add members",
+		})
+	}
+
+	userIDs, err := existingUserIDs(req.UserIDs, claims.ID)
+	if err != nil {
+		log.Println("Error checking conversation members:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if len(userIDs) == 0 || len(userIDs) != len(uniqueIDs(req.UserIDs, claims.ID)) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "One or more users do not exist",
+		})
+	}
+
+	for _, id := range userIDs {
+		member := models.ConversationMember{
+			ConversationID: uint(conversationID),
+			UserID:         id,
+			Role:           models.RoleMember,
+		}
+		// Adding someone who is already a member is a no-op
+		if err := database.DB.Where(models.ConversationMember{
+			ConversationID: member.ConversationID,
+			UserID:         member.UserID,
+		}).FirstOrCreate(&member).Error; err != nil {
+			log.Println("Error adding conversation member:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to add members",
+			})
+		}
+	}
+
+	return respondConversationUpdated(c, uint(conversationID))
+}
+
+// RemoveConversationMember removes a user from a group. Members may remove
+// themselves (leave); owners and admins may remove members ranked below them.
+func RemoveConversationMember(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	conversationID, err := strconv.Atoi(c.Params("conversationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid conversation ID",
+		})
+	}
+
+	targetID, err := strconv.Atoi(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	actor, err := getMembership(uint(conversationID), claims.ID)
+	if err != nil {
+		return membershipError(c, err)
+	}
+
+	target, err := getMembership(uint(conversationID), uint(targetID))
+	if err != nil {
+		return membershipError(c, err)
+	}
+
+	if target.Role == models.RoleOwner {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The owner must transfer ownership before leaving",
+		})
+	}
+	if target.UserID != actor.UserID &&
+		(models.RoleRank(actor.Role) < models.RoleRank(models.RoleAdmin) ||
+			models.RoleRank(actor.Role) <= models.RoleRank(target.Role)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You are not allowed to remove this member",
+		})
+	}
+
+	if err := database.DB.Delete(&target).Error; err != nil {
+		log.Println("Error removing conversation member:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove member",
+		})
+	}
+
+	utils.EmitToUser(target.UserID, fiber.Map{
+		"event":          "removedFromConversation",
+		"conversationId": conversationID,
+	})
+
+	return respondConversationUpdated(c, uint(conversationID))
+}
+
+// UpdateConversationMemberRole changes a member's role; owners only. Making
+// someone the owner transfers ownership and demotes the current owner to admin.
+func UpdateConversationMemberRole(c *fiber.Ctx) error {
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	conversationID, err := strconv.Atoi(c.Params("conversationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid conversation ID",
+		})
+	}
+
+	targetID, err := strconv.Atoi(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if models.RoleRank(req.Role) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be one of owner, admin or member",
+		})
+	}
+
+	actor, err := getMembership(uint(conversationID), claims.ID)
+	if err != nil {
+		return membershipError(c, err)
+	}
+	if actor.Role != models.RoleOwner {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the owner can change roles",
+		})
+	}
+
+	target, err := getMembership(uint(conversationID), uint(targetID))
+	if err != nil {
+		return membershipError(c, err)
+	}
+	if target.UserID == actor.UserID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Transfer ownership to another member instead",
+		})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if req.Role == models.RoleOwner {
+			if err := tx.Model(&actor).Update("role", models.RoleAdmin).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&target).Update("role", req.Role).Error
+	})
+	if err != nil {
+		log.Println("Error updating member role:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+
+	return respondConversationUpdated(c, uint(conversationID))
+}
+
+var errNotMember = errors.New("not a member of this conversation")
+
+// getMembership loads the membership of a user in a conversation
+func getMembership(conversationID, userID uint) (models.ConversationMember, error) {
+	var member models.ConversationMember
+	err := database.DB.Where("conversation_id = ? AND user_id = ?",
+		conversationID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return member, errNotMember
+	}
+	return member, err
+}
+
+// membershipError maps a getMembership error to a response
+func membershipError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errNotMember) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Conversation or member not found",
+		})
+	}
+	log.Println("Error fetching conversation membership:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Internal server error",
+	})
+}
+
+// conversationMemberIDs returns the user IDs of every member of a conversation
+func conversationMemberIDs(conversationID uint) ([]uint, error) {
+	var ids []uint
+	err := database.DB.Model(&models.ConversationMember{}).
+		Where("conversation_id = ?", conversationID).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// loadConversation fetches a conversation with its members and their public profile
+func loadConversation(conversationID uint) (models.Conversation, error) {
+	var conversation models.Conversation
+	err := database.DB.
+		Preload("Members", preloadMemberUsers).
+		Preload("Members.User", selectPublicUserFields).
+		First(&conversation, conversationID).Error
+	return conversation, err
+}
+
+// respondConversationUpdated notifies all members of a changed conversation
+// and returns it to the caller
+func respondConversationUpdated(c *fiber.Ctx, conversationID uint) error {
+	// Touch the conversation so it sorts by latest activity
+	database.DB.Model(&models.Conversation{ID: conversationID}).
+		Update("updated_at", gorm.Expr("NOW()"))
+
+	conversation, err := loadConversation(conversationID)
+	if err != nil {
+		log.Println("Error fetching conversation:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	memberIDs := make([]uint, 0, len(conversation.Members))
+	for _, member := range conversation.Members {
+		memberIDs = append(memberIDs, member.UserID)
+	}
+	utils.EmitToUsers(memberIDs, fiber.Map{
+		"event":        "conversationUpdated",
+		"conversation": conversation,
+	})
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"conversation": conversation,
+	})
+}
+
+// existingUserIDs returns the distinct IDs out of ids that belong to real
+// users, leaving out the excluded ID
+func existingUserIDs(ids []uint, exclude uint) ([]uint, error) {
+	ids = uniqueIDs(ids, exclude)
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	var found []uint
+	err := database.DB.Model(&models.User{}).Where("id IN ?", ids).
+		Pluck("id", &found).Error
+	return found, err
+}
+
+// uniqueIDs removes duplicates and the excluded ID from ids
+func uniqueIDs(ids []uint, exclude uint) []uint {
+	seen := map[uint]bool{exclude: true}
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func preloadMemberUsers(db *gorm.DB) *gorm.DB {
+	return db.Order("id ASC")
+}
+
+// selectPublicUserFields avoids loading password hashes with associations
+func selectPublicUserFields(db *gorm.DB) *gorm.DB {
+	return db.Select("id, email, full_name, profile_pic, profile_pic_preview, " +
+		"profile_pic_thumbnail, type, bot_owner_id, created_at, updated_at")
+}
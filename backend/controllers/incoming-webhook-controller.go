@@ -0,0 +1,440 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	// Longest message an incoming webhook may produce, attachments included
+	incomingWebhookMaxText = 4000
+	// Most attachments per request
+	incomingWebhookMaxAttachments = 10
+	// Signed requests older than this are rejected as replays
+	incomingWebhookSignatureTolerance = 5 * time.Minute
+)
+
+// incomingAttachment is a block of structured content in an incoming
+// webhook request, rendered into the message text
+type incomingAttachment struct {
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Text   string `json:"text"`
+	Fields []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"fields"`
+}
+
+// CreateIncomingWebhook creates a webhook URL that posts into a group
+// conversation (owners and admins only) or a direct chat with a user. It
+// posts as one of the caller's bots, or as a new bot named after it. The
+// secret is only shown this once.
+func CreateIncomingWebhook(c *fiber.Ctx) error {
+	var req struct {
+		Name           string `json:"name"`
+		ConversationID *uint  `json:"conversationId"`
+		UserID         *uint  `json:"userId"`
+		BotID          *uint  `json:"botId"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxTokenNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Webhook name is required and must be at most 100 characters",
+		})
+	}
+	if (req.ConversationID == nil) == (req.UserID == nil) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Either conversationId or userId is required",
+		})
+	}
+
+	if req.ConversationID != nil {
+		actor, err := getMembership(*req.ConversationID, claims.ID)
+		if err != nil {
+			return membershipError(c, err)
+		}
+		if models.RoleRank(actor.Role) < models.RoleRank(models.RoleAdmin) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Only owners and admins can add webhooks",
+			})
+		}
+	} else {
+		found, err := existingUserIDs([]uint{*req.UserID}, 0)
+		if err != nil {
+			log.Println("Error checking webhook target:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Internal server error",
+			})
+		}
+		if len(found) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "User does not exist",
+			})
+		}
+	}
+
+	var bot models.User
+	if req.BotID != nil {
+		var err error
+		if bot, err = loadOwnedBot(strconv.FormatUint(uint64(*req.BotID), 10), claims.ID); err != nil {
+			return botLookupError(c, err)
+		}
+	} else {
+		var err error
+		if bot, err = newBotUser(req.Name, claims.ID); err != nil {
+			log.Println("Error preparing webhook bot:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create webhook",
+			})
+		}
+	}
+
+	secret := "whsec_" + utils.GenerateToken(32)
+	webhook := models.IncomingWebhook{
+		OwnerID:        claims.ID,
+		Name:           req.Name,
+		ConversationID: req.ConversationID,
+		TargetUserID:   req.UserID,
+		Key:            utils.GenerateToken(24),
+		Secret:         secret,
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if bot.ID == 0 {
+			if err := tx.Create(&bot).Error; err != nil {
+				return err
+			}
+		}
+		webhook.BotID = bot.ID
+
+		// The bot has to be a member to post into the group
+		if webhook.ConversationID != nil {
+			member := models.ConversationMember{
+				ConversationID: *webhook.ConversationID,
+				UserID:         bot.ID,
+				Role:           models.RoleMember,
+			}
+			if err := tx.Where(models.ConversationMember{
+				ConversationID: member.ConversationID,
+				UserID:         member.UserID,
+			}).FirstOrCreate(&member).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&webhook).Error
+	})
+	if err != nil {
+		log.Println("Error creating incoming webhook:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create webhook",
+		})
+	}
+
+	if webhook.ConversationID != nil {
+		if conversation, err := loadConversation(*webhook.ConversationID); err == nil {
+			memberIDs := make([]uint, 0, len(conversation.Members))
+			for _, member := range conversation.Members {
+				memberIDs = append(memberIDs, member.UserID)
+			}
+			utils.EmitToUsers(memberIDs, fiber.Map{
+				"event":        "conversationUpdated",
+				"conversation": conversation,
+			})
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"webhook": webhook,
+		"url":     c.BaseURL() + "/api/hooks/" + webhook.Key,
+		"secret":  secret,
+	})
+}
+
+// GetIncomingWebhooks lists the caller's incoming webhooks
+func GetIncomingWebhooks(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	var webhooks []models.IncomingWebhook
+	if err := database.DB.Where("owner_id = ?", claims.ID).
+		Order("id ASC").Find(&webhooks).Error; err != nil {
+		log.Println("Error fetching incoming webhooks:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"webhooks": webhooks,
+	})
+}
+
+// DeleteIncomingWebhook disables a webhook URL. Its bot is left as is.
+func DeleteIncomingWebhook(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	webhookID, err := strconv.Atoi(c.Params("webhookId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	result := database.DB.Where("id = ? AND owner_id = ?", webhookID, claims.ID).
+		Delete(&models.IncomingWebhook{})
+	if result.Error != nil {
+		log.Println("Error deleting incoming webhook:", result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete webhook",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Webhook deleted",
+	})
+}
+
+// PostIncomingWebhook turns an external request into a message. The caller
+// authenticates with "Authorization: Bearer <secret>" or by signing the
+// body like outgoing webhooks do (X-Chat-Timestamp and X-Chat-Signature).
+func PostIncomingWebhook(c *fiber.Ctx) error {
+	var webhook models.IncomingWebhook
+	if err := database.DB.Where("key = ?", c.Params("key")).
+		First(&webhook).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	if !incomingWebhookAuthorized(c, webhook) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid webhook secret or signature",
+		})
+	}
+
+	var req struct {
+		Text        string               `json:"text"`
+		ImageURL    string               `json:"imageUrl"`
+		Attachments []incomingAttachment `json:"attachments"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	if len(req.Attachments) > incomingWebhookMaxAttachments {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Too many attachments",
+		})
+	}
+	text := renderIncomingMessage(req.Text, req.Attachments)
+	if text == "" && req.ImageURL == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Message text, image or attachments are required",
+		})
+	}
+	if len(text) > incomingWebhookMaxText {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Message is too long",
+		})
+	}
+	if req.ImageURL != "" && !isHTTPURL(req.ImageURL) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "imageUrl must be an absolute http or https URL",
+		})
+	}
+
+	var bot models.User
+	if err := database.DB.First(&bot, webhook.BotID).Error; err != nil {
+		log.Println("Error fetching webhook bot:", err)
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Webhook bot no longer exists",
+		})
+	}
+
+	message := models.Message{Text: text}
+	var recipients []uint
+	if webhook.ConversationID != nil {
+		if _, err := getMembership(*webhook.ConversationID, bot.ID); err != nil {
+			if errors.Is(err, errNotMember) {
+				return c.Status(fiber.StatusGone).JSON(fiber.Map{
+					"error": "Webhook bot was removed from the conversation",
+				})
+			}
+			return membershipError(c, err)
+		}
+
+		// Only as long as whoever added the webhook may still add one
+		owner, err := getMembership(*webhook.ConversationID, webhook.OwnerID)
+		if err != nil && !errors.Is(err, errNotMember) {
+			return membershipError(c, err)
+		}
+		if err != nil || models.RoleRank(owner.Role) < models.RoleRank(models.RoleAdmin) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Webhook owner is no longer an owner or admin of the conversation",
+			})
+		}
+
+		memberIDs, err := conversationMemberIDs(*webhook.ConversationID)
+		if err != nil {
+			log.Println("Error fetching conversation members:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Internal server error",
+			})
+		}
+		recipients = uniqueIDs(memberIDs, bot.ID)
+		message.ConversationID = webhook.ConversationID
+	} else {
+		recipients = []uint{*webhook.TargetUserID}
+		message.ReceiverID = *webhook.TargetUserID
+	}
+
+	// The image is copied into storage like an upload, so it is cleaned
+	// and resized, and clients never load a URL chosen by the caller
+	if req.ImageURL != "" {
+		data, err := utils.DownloadImage(c.Context(), req.ImageURL)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "imageUrl could not be downloaded",
+			})
+		}
+		image, err := utils.StoreImage(context.Background(), "messages", data)
+		if errors.Is(err, utils.ErrInvalidImage) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "imageUrl is not a supported image",
+			})
+		}
+		if err != nil {
+			log.Println("Error uploading webhook image:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to upload image",
+			})
+		}
+		message.Image = image.URL
+		message.ImagePreview = image.PreviewURL
+		message.ImageThumbnail = image.ThumbnailURL
+		message.ImageKeys = image.Keys
+	}
+
+	if err := deliverMessage(&message, bot, recipients); err != nil {
+		utils.DeleteImageKeys(context.Background(), message.ImageKeys...)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save message",
+		})
+	}
+
+	database.DB.Model(&webhook).Update("last_used_at", time.Now())
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"messageId": message.ID,
+	})
+}
+
+// incomingWebhookAuthorized checks the bearer secret or the body signature
+func incomingWebhookAuthorized(c *fiber.Ctx, webhook models.IncomingWebhook) bool {
+	scheme, token, found := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)),
+			[]byte(webhook.Secret)) == 1
+	}
+
+	timestamp, err := strconv.ParseInt(c.Get(utils.WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > incomingWebhookSignatureTolerance || age < -incomingWebhookSignatureTolerance {
+		return false
+	}
+	expected := utils.SignWebhookPayload(webhook.Secret, timestamp, c.Body())
+	return subtle.ConstantTimeCompare([]byte(c.Get(utils.WebhookSignatureHeader)),
+		[]byte(expected)) == 1
+}
+
+// renderIncomingMessage appends the attachments to the text as plain text
+// blocks, since messages have no rich formatting
+func renderIncomingMessage(text string, attachments []incomingAttachment) string {
+	blocks := []string{}
+	if text = strings.TrimSpace(text); text != "" {
+		blocks = append(blocks, text)
+	}
+
+	for _, attachment := range attachments {
+		var lines []string
+		title := strings.TrimSpace(attachment.Title)
+		link := strings.TrimSpace(attachment.URL)
+		switch {
+		case title != "" && link != "":
+			lines = append(lines, title+" ("+link+")")
+		case title != "":
+			lines = append(lines, title)
+		case link != "":
+			lines = append(lines, link)
+		}
+		if body := strings.TrimSpace(attachment.Text); body != "" {
+			lines = append(lines, body)
+		}
+		for _, field := range attachment.Fields {
+			name := strings.TrimSpace(field.Name)
+			value := strings.TrimSpace(field.Value)
+			if name == "" && value == "" {
+				continue
+			}
+			lines = append(lines, name+": "+value)
+		}
+		if len(lines) > 0 {
+			blocks = append(blocks, strings.Join(lines, "\n"))
+		}
+	}
+
+	return strings.Join(blocks, "\n\n")
+}
+
+// isHTTPURL reports whether s is an absolute http(s) URL
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const memoryStorageURL = "https://media.test/"
+
+// memoryStorage keeps media in a map instead of a storage backend
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memoryStorage) Put(ctx context.Context, key, contentType string,
+	data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return memoryStorageURL + key, nil
+}
+
+func (s *memoryStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStorage) KeyFromURL(url string) string {
+	key, ok := strings.CutPrefix(url, memoryStorageURL)
+	if !ok {
+		return ""
+	}
+	return key
+}
+
+func (s *memoryStorage) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[key]
+	return ok
+}
+
+func (s *memoryStorage) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+func useMemoryStorage(t *testing.T) *memoryStorage {
+	t.Helper()
+	storage := &memoryStorage{objects: make(map[string][]byte)}
+	previous := utils.MediaStorage
+	utils.MediaStorage = storage
+	t.Cleanup(func() { utils.MediaStorage = previous })
+	return storage
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveImages stands in for the sites images are posted from
+func serveImages(t *testing.T, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := utils.RemoteImageHTTPClient
+	utils.RemoteImageHTTPClient = server.Client()
+	t.Cleanup(func() { utils.RemoteImageHTTPClient = previous })
+	return server
+}
+
+// setupIncomingWebhook creates a user with a bot posting to them through a
+// webhook, and an app serving the webhook and message deletion as the bot
+func setupIncomingWebhook(t *testing.T) (models.User, *fiber.App) {
+	t.Helper()
+	databasetest.Open(t, &models.User{}, &models.IncomingWebhook{}, &models.Message{},
+		&models.MessageEdit{}, &models.MessageReaction{}, &models.MessageDeletion{},
+		&models.Attachment{}, &models.BotWebhook{})
+
+	owner := models.User{Email: "owner@example.com", FullName: "Owner", Password: "x"}
+	if err := database.DB.Create(&owner).Error; err != nil {
+		t.Fatal(err)
+	}
+	bot := models.User{Email: "bot@bots.invalid", FullName: "Bot", Password: "x",
+		Type: models.UserTypeBot, BotOwnerID: &owner.ID}
+	if err := database.DB.Create(&bot).Error; err != nil {
+		t.Fatal(err)
+	}
+	webhook := models.IncomingWebhook{OwnerID: owner.ID, BotID: bot.ID, Name: "CI",
+		TargetUserID: &owner.ID, Key: "hook-key", Secret: "hook-secret"}
+	if err := database.DB.Create(&webhook).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/api/hooks/:key", PostIncomingWebhook)
+	app.Delete("/api/messages/delete/:messageId", func(c *fiber.Ctx) error {
+		c.Locals("user", bot)
+		return c.Next()
+	}, DeleteMessage)
+	return bot, app
+}
+
+func postToWebhook(t *testing.T, app *fiber.App, body map[string]string) (int, uint) {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/api/hooks/hook-key", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer hook-secret")
+	resp, err := app.Test(req, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		MessageID uint `json:"messageId"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result.MessageID
+}
+
+func deleteForEveryone(t *testing.T, app *fiber.App, messageID uint) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodDelete,
+		"/api/messages/delete/"+strconv.FormatUint(uint64(messageID), 10)+"?scope=everyone", nil)
+	resp, err := app.Test(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %v, status %v", err, resp.StatusCode)
+	}
+}
+
+func TestPostIncomingWebhookStoresImage(t *testing.T) {
+	storage := useMemoryStorage(t)
+	_, app := setupIncomingWebhook(t)
+	server := serveImages(t, map[string][]byte{"/chart.png": testPNG(t)})
+
+	status, messageID := postToWebhook(t, app, map[string]string{
+		"imageUrl": server.URL + "/chart.png",
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("status = %d", status)
+	}
+
+	var message models.Message
+	database.DB.First(&message, messageID)
+	if !strings.HasPrefix(message.Image, memoryStorageURL+"messages/") {
+		t.Fatalf("image = %q, want a copy in storage", message.Image)
+	}
+	if len(message.ImageKeys) == 0 {
+		t.Fatal("the stored image's keys were not recorded")
+	}
+	for _, key := range message.ImageKeys {
+		if !storage.has(key) {
+			t.Fatalf("%s is not stored", key)
+		}
+	}
+
+	deleteForEveryone(t, app, messageID)
+	if storage.count() != 0 {
+		t.Fatalf("%d files left after deleting the message", storage.count())
+	}
+}
+
+func TestPostIncomingWebhookRejectsImage(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"not found", "/missing.png"},
+		{"not an image", "/page.html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := useMemoryStorage(t)
+			_, app := setupIncomingWebhook(t)
+			server := serveImages(t, map[string][]byte{"/page.html": []byte("<html></html>")})
+
+			status, _ := postToWebhook(t, app, map[string]string{"imageUrl": server.URL + tt.path})
+			if status != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+			}
+			var messages int64
+			database.DB.Model(&models.Message{}).Count(&messages)
+			if messages != 0 || storage.count() != 0 {
+				t.Fatalf("%d messages and %d files stored", messages, storage.count())
+			}
+		})
+	}
+}
+
+// A message's image URL may name any file in storage, so deleting the
+// message must only remove the files it uploaded itself
+func TestDeleteMessageKeepsFilesItDidNotUpload(t *testing.T) {
+	storage := useMemoryStorage(t)
+	bot, app := setupIncomingWebhook(t)
+
+	victimURL, _ := storage.Put(context.Background(), "profile-pics/victim.jpg",
+		"image/jpeg", []byte("victim"))
+	message := models.Message{SenderID: bot.ID, ReceiverID: *bot.BotOwnerID,
+		Image: victimURL, ImagePreview: victimURL, ImageThumbnail: victimURL}
+	if err := database.DB.Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	deleteForEveryone(t, app, message.ID)
+	if !storage.has("profile-pics/victim.jpg") {
+		t.Fatal("deleting the message removed a file it did not upload")
+	}
+}
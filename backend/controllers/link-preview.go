@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long fetching a preview may take, following redirects included
+const linkPreviewTimeout = 30 * time.Second
+
+// linkPreviewQueue feeds the links of new messages to a fixed number of
+// workers (LINK_PREVIEW_WORKERS, default 4). A link is fetched once however
+// many messages are waiting for it, and at most LINK_PREVIEW_QUEUE_SIZE
+// (default 200) links wait at a time; messages beyond that get no preview,
+// so a flood of messages cannot turn into a flood of outgoing requests.
+type linkPreviewQueue struct {
+	mu sync.Mutex
+	// The messages waiting for each link, queued or being fetched
+	waiting map[string][]models.Message
+	links   chan string
+}
+
+var linkPreviews = sync.OnceValue(func() *linkPreviewQueue {
+	size := max(utils.GetEnvInt("LINK_PREVIEW_QUEUE_SIZE", 200), 1)
+	queue := &linkPreviewQueue{
+		waiting: make(map[string][]models.Message),
+		links:   make(chan string, size),
+	}
+	for i := 0; i < max(utils.GetEnvInt("LINK_PREVIEW_WORKERS", 4), 1); i++ {
+		go queue.work()
+	}
+	return queue
+})
+
+// scheduleLinkPreview fetches the preview of the first link in a message in
+// the background. Once it is there it is attached to the message and pushed
+// to the participants as a messageUpdated event, unless the message has
+// been edited or deleted meanwhile.
+func scheduleLinkPreview(message models.Message) {
+	link := utils.FirstURL(message.Text)
+	if link == "" {
+		return
+	}
+	linkPreviews().add(link, message)
+}
+
+// add queues a link for a message, or adds the message to those already
+// waiting for it
+func (q *linkPreviewQueue) add(link string, message models.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if messages, ok := q.waiting[link]; ok {
+		q.waiting[link] = append(messages, message)
+		return
+	}
+
+	// The channel holds every waiting link, so it only fills up with them
+	select {
+	case q.links <- link:
+		q.waiting[link] = []models.Message{message}
+	default:
+		log.Println("Link preview queue is full, skipping", link)
+	}
+}
+
+func (q *linkPreviewQueue) work() {
+	for link := range q.links {
+		ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+		preview, err := utils.LinkPreviewFor(ctx, link)
+		cancel()
+
+		// Messages arriving from now on queue the link again, and find
+		// the preview cached
+		q.mu.Lock()
+		messages := q.waiting[link]
+		delete(q.waiting, link)
+		q.mu.Unlock()
+
+		if err != nil {
+			log.Println("Error fetching link preview:", err)
+			continue
+		}
+		if preview.Failed {
+			continue
+		}
+		for _, message := range messages {
+			attachLinkPreview(message, preview)
+		}
+	}
+}
+
+// attachLinkPreview links a fetched preview to a message and pushes it to
+// the participants
+func attachLinkPreview(message models.Message, preview models.LinkPreview) {
+	result := database.DB.Model(&models.Message{}).
+		Where("id = ? AND text = ? AND deleted_at IS NULL", message.ID, message.Text).
+		Update("link_preview_id", preview.ID)
+	if result.Error != nil {
+		log.Println("Error attaching link preview:", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	emitToParticipants(message, fiber.Map{
+		"event":          "messageUpdated",
+		"messageId":      message.ID,
+		"conversationId": message.ConversationID,
+		"linkPreview":    preview,
+	})
+}
+
+// attachLinkPreviews fills in the link previews of the messages
+func attachLinkPreviews(messages []models.Message) error {
+	var ids []uint
+	for _, message := range messages {
+		if message.LinkPreviewID != nil {
+			ids = append(ids, *message.LinkPreviewID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var previews []models.LinkPreview
+	if err := database.DB.Where("id IN ?", uniqueIDs(ids, 0)).
+		Find(&previews).Error; err != nil {
+		return err
+	}
+
+	byID := make(map[uint]*models.LinkPreview, len(previews))
+	for i := range previews {
+		byID[previews[i].ID] = &previews[i]
+	}
+	for i := range messages {
+		if messages[i].LinkPreviewID != nil {
+			messages[i].LinkPreview = byID[*messages[i].LinkPreviewID]
+		}
+	}
+	return nil
+}
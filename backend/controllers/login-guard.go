@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// loginThrottle turns recent failed logins sharing a key (an email address
+// or an IP address) into a temporary lockout. Past the threshold every
+// further failure doubles the lockout, up to LOGIN_LOCKOUT_MAX.
+type loginThrottle struct {
+	column    string
+	threshold func() int
+	// Whether a successful login clears the failures counted so far
+	resetOnSuccess bool
+}
+
+var (
+	accountThrottle = loginThrottle{
+		column: "email",
+		threshold: func() int {
+			return utils.GetEnvInt("LOGIN_MAX_FAILURES_PER_ACCOUNT", 5)
+		},
+		resetOnSuccess: true,
+	}
+	// An attacker could reset an IP counter by logging into their own
+	// account, so successes do not count here. Behind a reverse proxy
+	// TRUSTED_PROXIES must be set, or every client shares the proxy's IP.
+	ipThrottle = loginThrottle{
+		column: "ip_address",
+		threshold: func() int {
+			return utils.GetEnvInt("LOGIN_MAX_FAILURES_PER_IP", 20)
+		},
+	}
+)
+
+// loginFailureWindow is how far back failures are counted
+func loginFailureWindow() time.Duration {
+	return utils.GetEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+}
+
+// lockedFor returns how much longer the key is locked out, or 0
+func (t loginThrottle) lockedFor(value string) (time.Duration, error) {
+	since := time.Now().Add(-loginFailureWindow())
+
+	// Rows are read rather than aggregated: MAX over a timestamp comes
+	// back NULL, which a *time.Time cannot hold, when nothing matches
+	if t.resetOnSuccess {
+		var lastSuccess models.LoginAttempt
+		err := database.DB.Select("created_at").
+			Where(t.column+" = ? AND success = ? AND created_at > ?", value, true, since).
+			Order("created_at DESC").Take(&lastSuccess).Error
+		if err == nil {
+			since = lastSuccess.CreatedAt
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, err
+		}
+	}
+
+	failures := func() *gorm.DB {
+		return database.DB.Model(&models.LoginAttempt{}).
+			Where(t.column+" = ? AND success = ? AND reason <> ? AND created_at > ?",
+				value, false, models.LoginReasonLocked, since)
+	}
+	var count int64
+	if err := failures().Count(&count).Error; err != nil {
+		return 0, err
+	}
+	excess := int(count) - t.threshold()
+	if excess < 0 {
+		return 0, nil
+	}
+	var lastFailure models.LoginAttempt
+	if err := failures().Select("created_at").Order("created_at DESC").
+		Take(&lastFailure).Error; err != nil {
+		return 0, err
+	}
+
+	maxLockout := utils.GetEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour)
+	lockout := utils.GetEnvDuration("LOGIN_LOCKOUT_BASE", 30*time.Second)
+	for i := 0; i < excess && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+	lockout = min(lockout, maxLockout)
+
+	return max(time.Until(lastFailure.CreatedAt.Add(lockout)), 0), nil
+}
+
+// loginLockout returns the longest lockout applying to an email address or
+// an IP address, or 0 when logging in is allowed
+func loginLockout(email, ip string) (time.Duration, error) {
+	accountWait, err := accountThrottle.lockedFor(email)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := ipThrottle.lockedFor(ip)
+	if err != nil {
+		return 0, err
+	}
+	return max(accountWait, ipWait), nil
+}
+
+// recordLoginAttempt writes the audit record of a login attempt
+func recordLoginAttempt(c *fiber.Ctx, email string, userID *uint, reason string) {
+	attempt := models.LoginAttempt{
+		Email:     email,
+		UserID:    userID,
+		IPAddress: c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Success:   reason == models.LoginReasonSuccess,
+		Reason:    reason,
+	}
+	if err := database.DB.Create(&attempt).Error; err != nil {
+		log.Println("Error recording login attempt:", err)
+	}
+}
+
+// loginLockedResponse answers a locked out login attempt. It is the same
+// for existing and unknown accounts.
+func loginLockedResponse(c *fiber.Ctx, wait time.Duration) error {
+	seconds := int(wait.Seconds()) + 1
+	c.Set(fiber.HeaderRetryAfter, fmt.Sprint(seconds))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":      "too many failed login attempts, please try again later",
+		"retryAfter": seconds,
+	})
+}
+
+// normalizeEmail is the form email addresses are counted under
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so such
+// attempts take as long as a wrong password and timing reveals nothing
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not-a-real-password"),
+		bcrypt.DefaultCost)
+	if err != nil {
+		log.Println("Error generating dummy password hash:", err)
+	}
+	return hash
+})
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recordAttempts writes n login attempts made age ago
+func recordAttempts(t *testing.T, n int, email, ip, reason string, age time.Duration) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		attempt := models.LoginAttempt{Email: email, IPAddress: ip, Reason: reason,
+			Success: reason == models.LoginReasonSuccess, CreatedAt: time.Now().Add(-age)}
+		if err := database.DB.Create(&attempt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	const email, ip = "user@example.com", "203.0.113.7"
+
+	tests := []struct {
+		name   string
+		record func(t *testing.T)
+		// The lockout expected, to within a few seconds; 0 for none
+		want time.Duration
+	}{
+		{
+			name:   "no attempts",
+			record: func(t *testing.T) {},
+		},
+		{
+			name: "below the account threshold",
+			record: func(t *testing.T) {
+				recordAttempts(t, 4, email, "198.51.100.1", models.LoginReasonWrongPassword, 0)
+			},
+		},
+		{
+			name: "at the account threshold",
+			record: func(t *testing.T) {
+				recordAttempts(t, 5, email, "198.51.100.1", models.LoginReasonWrongPassword, 0)
+			},
+			want: 30 * time.Second,
+		},
+		{
+			name: "doubling past the threshold",
+			record: func(t *testing.T) {
+				recordAttempts(t, 7, email, "198.51.100.1", models.LoginReasonWrongPassword, 0)
+			},
+			want: 2 * time.Minute,
+		},
+		{
+			name: "capped at the maximum",
+			record: func(t *testing.T) {
+				recordAttempts(t, 40, email, "198.51.100.1", models.LoginReasonWrongPassword, 0)
+			},
+			want: time.Hour,
+		},
+		{
+			name: "failures outside the window",
+			record: func(t *testing.T) {
+				recordAttempts(t, 10, email, "198.51.100.1", models.LoginReasonWrongPassword,
+					20*time.Minute)
+			},
+		},
+		{
+			name: "attempts refused while locked",
+			record: func(t *testing.T) {
+				recordAttempts(t, 4, email, "198.51.100.1", models.LoginReasonWrongPassword, 0)
+				recordAttempts(t, 10, email, "198.51.100.1", models.LoginReasonLocked, 0)
+			},
+		},
+		{
+			name: "failures before a successful login",
+			record: func(t *testing.T) {
+				recordAttempts(t, 5, email, "198.51.100.1", models.LoginReasonWrongPassword,
+					time.Minute)
+				recordAttempts(t, 1, email, "198.51.100.1", models.LoginReasonSuccess, 0)
+			},
+		},
+		{
+			name: "at the IP threshold, across accounts",
+			record: func(t *testing.T) {
+				for i := 0; i < 20; i++ {
+					recordAttempts(t, 1, fmt.Sprintf("user%d@example.com", i), ip,
+						models.LoginReasonUnknownEmail, 0)
+				}
+			},
+			want: 30 * time.Second,
+		},
+		{
+			// Or an attacker could clear it by logging into their own account
+			name: "IP failures despite a successful login",
+			record: func(t *testing.T) {
+				for i := 0; i < 20; i++ {
+					recordAttempts(t, 1, fmt.Sprintf("user%d@example.com", i), ip,
+						models.LoginReasonUnknownEmail, time.Second)
+				}
+				recordAttempts(t, 1, "attacker@example.com", ip, models.LoginReasonSuccess, 0)
+			},
+			want: 30 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			databasetest.Open(t, &models.LoginAttempt{})
+			tt.record(t)
+
+			wait, err := loginLockout(email, ip)
+			if err != nil {
+				t.Fatalf("loginLockout: %v", err)
+			}
+			if wait > tt.want || wait < tt.want-5*time.Second {
+				t.Fatalf("lockout = %v, want %v", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginLocksOutEverySpellingOfAnEmail(t *testing.T) {
+	databasetest.Open(t, &models.User{}, &models.LoginAttempt{})
+	hash, _ := bcrypt.GenerateFromPassword([]byte("right-password"), bcrypt.MinCost)
+	user := models.User{Email: "user@example.com", FullName: "User", Password: string(hash)}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/api/auth/login", LoginHandler)
+
+	for i, email := range []string{"user@example.com", "User@Example.com", " USER@example.com",
+		"user@EXAMPLE.com", "uSer@example.com"} {
+		if status := postJSON(t, app, "/api/auth/login",
+			fmt.Sprintf(`{"email": %q, "password": "wrong-%d"}`, email, i)); status != http.StatusBadRequest {
+			t.Fatalf("wrong password for %q: status %d", email, status)
+		}
+	}
+
+	// Even the right password is refused until the lockout ends
+	if status := postJSON(t, app, "/api/auth/login",
+		`{"email": "user@example.com", "password": "right-password"}`); status != http.StatusTooManyRequests {
+		t.Fatalf("locked out login: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
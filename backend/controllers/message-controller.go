@@ -2,6 +2,8 @@ package controllers
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"log"
 	"strconv"
 	"time"
@@ -10,9 +12,81 @@ import (
 	"github.com/chat-app/models"
 	"github.com/chat-app/utils"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
-// GetUsersForSidebar retrieves all users except the logged-in user
+// sidebarContact is a user listed in the sidebar together with a summary of
+// the direct conversation with them
+type sidebarContact struct {
+	ID                  uint       `json:"id"`
+	Email               string     `json:"email"`
+	FullName            string     `json:"fullname"`
+	ProfilePic          string     `json:"profilePic"`
+	ProfilePicThumbnail string     `json:"profilePicThumbnail"`
+	Type                string     `json:"type"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	UnreadCount         int        `json:"unreadCount"`
+	LastMessageID       *uint      `json:"lastMessageId"`
+	LastMessageSenderID *uint      `json:"lastMessageSenderId"`
+	LastMessagePreview  *string    `json:"lastMessagePreview"`
+	LastMessageAt       *time.Time `json:"lastMessageAt"`
+}
+
+// Length of the last message preview, in characters
+const sidebarPreviewLength = 100
+
+// sidebarQuery lists every other user with their last direct message and
+// unread count in one round trip. Bots are only listed for their owner and
+// for users who have talked to them. The last message is picked from the two
+// directions separately so each side is a backward scan of
+// idx_messages_direct, and unread counts use idx_messages_unread. Messages
+// the user deleted for themselves are skipped in both, as in GetMessages.
+const sidebarQuery = `
+SELECT u.id, u.email, u.full_name, u.profile_pic, u.profile_pic_thumbnail, u.type, u.created_at, u.updated_at,
+	COALESCE(unread.count, 0) AS unread_count,
+	lm.id AS last_message_id,
+	lm.sender_id AS last_message_sender_id,
+	CASE
+		WHEN lm.deleted_at IS NOT NULL THEN '[deleted]'
+		WHEN lm.text <> '' THEN LEFT(lm.text, @previewLength)
+		WHEN lm.image <> '' THEN '[image]'
+		WHEN EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = lm.id AND a.kind = 'audio')
+			THEN '[voice message]'
+		WHEN EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = lm.id) THEN '[attachment]'
+	END AS last_message_preview,
+	lm.created_at AS last_message_at
+FROM users u
+LEFT JOIN LATERAL (
+	SELECT pair.* FROM (
+		(SELECT m.id, m.sender_id, m.text, m.image, m.deleted_at, m.created_at
+		FROM messages m
+		WHERE m.sender_id = u.id AND m.receiver_id = @me AND m.conversation_id IS NULL
+			AND NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = @me)
+		ORDER BY m.id DESC LIMIT 1)
+		UNION ALL
+		(SELECT m.id, m.sender_id, m.text, m.image, m.deleted_at, m.created_at
+		FROM messages m
+		WHERE m.sender_id = @me AND m.receiver_id = u.id AND m.conversation_id IS NULL
+			AND NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = @me)
+		ORDER BY m.id DESC LIMIT 1)
+	) pair
+	ORDER BY pair.id DESC LIMIT 1
+) lm ON TRUE
+LEFT JOIN (
+	SELECT m.sender_id, COUNT(*) AS count
+	FROM messages m
+	WHERE m.receiver_id = @me AND m.conversation_id IS NULL AND m.read_at IS NULL
+		AND m.deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = @me)
+	GROUP BY m.sender_id
+) unread ON unread.sender_id = u.id
+WHERE u.id <> @me
+	AND (u.type <> 'bot' OR u.bot_owner_id = @me OR lm.id IS NOT NULL)
+ORDER BY lm.id DESC NULLS LAST, u.full_name ASC`
+
+// GetUsersForSidebar retrieves all users except the logged-in user, most
+// recent conversations first, with unread counts and last message previews
 func GetUsersForSidebar(c *fiber.Ctx) error {
 	// Get logged-in user ID
 	claims, ok := c.Locals("user").(models.User)
@@ -24,10 +98,11 @@ func GetUsersForSidebar(c *fiber.Ctx) error {
 	userID := claims.ID
 
 	// Fetch users excluding the logged-in user
-	var users []models.User
-	if err := database.DB.Where("id != ?", userID).Select(
-		"id, email, full_name, profile_pic, created_at, updated_at").
-		Find(&users).Error; err != nil {
+	var users []sidebarContact
+	if err := database.DB.Raw(sidebarQuery,
+		sql.Named("me", userID),
+		sql.Named("previewLength", sidebarPreviewLength),
+	).Scan(&users).Error; err != nil {
 		log.Println("Error fetching users for sidebar:", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Internal server error",
@@ -40,52 +115,105 @@ func GetUsersForSidebar(c *fiber.Ctx) error {
 	})
 }
 
+// GetMessages retrieves one page of the history of a direct chat with
+// another user, or of a group conversation when routed with a conversation ID
 func GetMessages(c *fiber.Ctx) error {
-	userToChatIDParam := c.Params("id")
-	if userToChatIDParam == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"message": "User ID is required",
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"message": "Unauthorized",
 		})
 	}
+	userID := claims.ID
 
-	userToChatID, err := strconv.Atoi(userToChatIDParam)
+	page, err := parseCursorPage(c)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"message": "Invalid User ID",
+			"message": err.Error(),
 		})
 	}
 
-	claims, ok := c.Locals("user").(models.User)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"message": "Unauthorized",
-		})
+	query := database.DB.Model(&models.Message{}).Scopes(notDeletedFor(userID))
+
+	if conversationIDParam := c.Params("conversationId"); conversationIDParam != "" {
+		conversationID, err := strconv.Atoi(conversationIDParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid conversation ID",
+			})
+		}
+
+		if _, err := getMembership(uint(conversationID), userID); err != nil {
+			return membershipError(c, err)
+		}
+
+		query = query.Where("conversation_id = ?", conversationID)
+	} else {
+		userToChatIDParam := c.Params("id")
+		if userToChatIDParam == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "User ID is required",
+			})
+		}
+
+		userToChatID, err := strconv.Atoi(userToChatIDParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid User ID",
+			})
+		}
+
+		query = query.Where(
+			"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+			userID, userToChatID, userToChatID, userID,
+		).Where("conversation_id IS NULL")
 	}
-	userID := claims.ID
 
-	var messages []models.Message
-	err = database.DB.Where(
-		"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
-		userID, userToChatID, userToChatID, userID,
-	).Order("created_at ASC").Find(&messages).Error
+	messages, nextCursor, err := paginateMessages(query, page)
 	if err != nil {
 		log.Println("Error fetching messages:", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"message": "Internal server error",
 		})
 	}
+	if err := attachReactions(messages, userID); err != nil {
+		log.Println("Error fetching reactions:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Internal server error",
+		})
+	}
+	if err := attachAttachments(messages); err != nil {
+		log.Println("Error fetching attachments:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Internal server error",
+		})
+	}
+	if err := attachLinkPreviews(messages); err != nil {
+		log.Println("Error fetching link previews:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Internal server error",
+		})
+	}
+	if err := attachParentQuotes(messages); err != nil {
+		log.Println("Error fetching quoted messages:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Internal server error",
+		})
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"messages": messages,
+		"messages":   messages,
+		"nextCursor": nextCursor,
 	})
 }
 
-
-// SendMessage handles sending a message (including text and image upload)
+// SendMessage handles sending a message (including text and image upload).
+// Files and voice messages are sent as multipart form data.
 func SendMessage(c *fiber.Ctx) error {
 	var req struct {
-		Text  string `json:"text"`
-		Image string `json:"image"`
+		Text     string `json:"text" form:"text"`
+		Image    string `json:"image" form:"image"`
+		ParentID *uint  `json:"parentId" form:"parentId"`
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -102,66 +230,247 @@ func SendMessage(c *fiber.Ctx) error {
 	}
 	userID := claims.ID
 
-	receiverID, err := strconv.Atoi(c.Params("id"))
+	message := models.Message{
+		SenderID: userID,
+		Text:     req.Text,
+	}
+
+	// Recipients are notified over the WebSocket once the message is saved
+	var recipients []uint
+
+	if conversationIDParam := c.Params("conversationId"); conversationIDParam != "" {
+		conversationID, err := strconv.Atoi(conversationIDParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid conversation ID",
+			})
+		}
+
+		if _, err := getMembership(uint(conversationID), userID); err != nil {
+			return membershipError(c, err)
+		}
+
+		memberIDs, err := conversationMemberIDs(uint(conversationID))
+		if err != nil {
+			log.Println("Error fetching conversation members:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Internal server error",
+			})
+		}
+
+		recipients = uniqueIDs(memberIDs, userID)
+		message.ConversationID = ptrTo(uint(conversationID))
+	} else {
+		receiverID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receiver ID",
+			})
+		}
+
+		recipients = []uint{uint(receiverID)}
+		message.ReceiverID = uint(receiverID)
+	}
+
+	// Files come as multipart form data alongside the other fields
+	uploads, err := readAttachments(c)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid receiver ID",
-		})
+		return attachmentUploadError(c, err)
 	}
 
-	if req.Text == "" && req.Image == "" {
+	if req.Text == "" && req.Image == "" && len(uploads) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Message text or image is required",
+			"error": "Message text, image or attachment is required",
 		})
 	}
 
-	var imageUrl string
-	if req.Image != "" {
-		cloudinaryService, err := utils.NewCloudinaryService()
+	if req.ParentID != nil {
+		parent, err := loadReplyParent(*req.ParentID, message)
+		if errors.Is(err, errParentNotFound) || errors.Is(err, errParentDeleted) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 		if err != nil {
+			log.Println("Error fetching parent message:", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to initialize Cloudinary service",
+				"error": "Internal server error",
 			})
 		}
+		message.ParentID = &parent.ID
+		message.Parent = quoteMessage(parent)
+	}
 
-		imageUrl, err = cloudinaryService.UploadImage(context.Background(), req.Image)
+	if req.Image != "" {
+		// The frontend sends images as base64 data URIs
+		data, _, err := utils.DecodeDataURI(req.Image)
 		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Image must be a base64 encoded image",
+			})
+		}
+
+		image, err := utils.StoreImage(context.Background(), "messages", data)
+		if errors.Is(err, utils.ErrInvalidImage) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Image must be a base64 encoded image",
+			})
+		}
+		if err != nil {
+			log.Println("Error uploading message image:", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Failed to upload image",
 			})
 		}
+		message.Image = image.URL
+		message.ImagePreview = image.PreviewURL
+		message.ImageThumbnail = image.ThumbnailURL
+		message.ImageKeys = image.Keys
 	}
 
-	message := models.Message{
-		SenderID:   userID,
-		ReceiverID: uint(receiverID),
-		Text:       req.Text,
-		Image:      imageUrl,
-		CreatedAt:  time.Now(),
+	message.Attachments, err = storeAttachments(context.Background(), uploads)
+	if err != nil {
+		log.Println("Error uploading attachments:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to upload attachments",
+		})
 	}
 
-	if err := database.DB.Create(&message).Error; err != nil {
+	if err := deliverMessage(&message, claims, recipients); err != nil {
+		utils.DeleteImageKeys(context.Background(), message.ImageKeys...)
+		deleteStoredAttachments(context.Background(), message.Attachments)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to save message",
 		})
 	}
 
-// Notify receiver via WebSocket
-receiverSocket := utils.GetReceiverSocket(receiverID)
-if receiverSocket != nil {
-	err := receiverSocket.WriteJSON(fiber.Map{
-		"event":   "newMessage",
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": message,
 	})
+}
+
+// deliverMessage saves a new message and pushes it to its recipients: over
+// the WebSocket to people and through their webhooks to bots. Every way of
+// sending a message ends here.
+func deliverMessage(message *models.Message, sender models.User, recipients []uint) error {
+	message.SenderID = sender.ID
+	message.CreatedAt = time.Now()
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		if len(message.Attachments) > 0 {
+			for i := range message.Attachments {
+				message.Attachments[i].MessageID = message.ID
+			}
+			if err := tx.Create(&message.Attachments).Error; err != nil {
+				return err
+			}
+		}
+		if message.ParentID == nil {
+			return nil
+		}
+		return tx.Model(&models.Message{}).Where("id = ?", *message.ParentID).
+			Update("reply_count", gorm.Expr("reply_count + 1")).Error
+	})
 	if err != nil {
-		log.Printf("Error sending WebSocket message to user %d: %v\n", receiverID, err)
-		utils.RemoveReceiverSocket(receiverID) // Clean up stale connection
+		log.Println("Error saving message:", err)
+		return err
+	}
+	if message.Parent != nil {
+		message.Parent.ReplyCount++
+	}
+	for i := range message.Attachments {
+		message.Attachments[i].URL = attachmentURL(message.Attachments[i].ID)
+	}
+
+	// Notify recipients via WebSocket
+	payload := fiber.Map{
+		"event":   "newMessage",
+		"message": message,
+	}
+	if message.ConversationID != nil {
+		utils.EmitToUsers(recipients, payload)
+	} else if utils.EmitToUser(message.ReceiverID, payload) > 0 {
+		// A live socket received it, so the message counts as delivered
+		deliveredAt := time.Now()
+		if err := database.DB.Model(message).
+			Update("delivered_at", deliveredAt).Error; err != nil {
+			log.Println("Error marking message delivered:", err)
+		} else {
+			message.DeliveredAt = &deliveredAt
+		}
 	}
+
+	// Bots among the recipients get the message through their webhooks
+	utils.EnqueueBotDeliveries(*message, sender, recipients)
+
+	// A preview of the first link follows as a messageUpdated event
+	scheduleLinkPreview(*message)
+	return nil
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
 }
 
+var errMessageNotFound = errors.New("message not found")
 
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"message": message,
+// loadMessageForUser fetches a message the user takes part in, either as
+// sender or receiver of a direct message or as a member of its group
+func loadMessageForUser(messageID, userID uint) (models.Message, error) {
+	var message models.Message
+	if err := database.DB.First(&message, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return message, errMessageNotFound
+		}
+		return message, err
+	}
+
+	if message.ConversationID != nil {
+		if _, err := getMembership(*message.ConversationID, userID); err != nil {
+			if errors.Is(err, errNotMember) {
+				return message, errMessageNotFound
+			}
+			return message, err
+		}
+		return message, nil
+	}
+
+	if message.SenderID != userID && message.ReceiverID != userID {
+		return message, errMessageNotFound
+	}
+	return message, nil
+}
+
+// messageParticipants returns every user who can see the message
+func messageParticipants(message models.Message) ([]uint, error) {
+	if message.ConversationID != nil {
+		return conversationMemberIDs(*message.ConversationID)
+	}
+	return []uint{message.SenderID, message.ReceiverID}, nil
+}
+
+// messageLookupError maps a loadMessageForUser error to a response
+func messageLookupError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errMessageNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Message not found",
+		})
+	}
+	log.Println("Error fetching message:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Internal server error",
 	})
 }
 
+// notDeletedFor hides messages the user deleted for themselves
+func notDeletedFor(userID uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(
+			"NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = messages.id AND d.user_id = ?)",
+			userID,
+		)
+	}
+}
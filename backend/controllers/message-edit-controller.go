@@ -0,0 +1,294 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// messageEditWindow is how long after sending a message its sender may edit
+// it or delete it for everyone. Set MESSAGE_EDIT_WINDOW to e.g. "30m";
+// "0" removes the limit.
+func messageEditWindow() time.Duration {
+	return utils.GetEnvDuration("MESSAGE_EDIT_WINDOW", 15*time.Minute)
+}
+
+// withinEditWindow reports whether the message is still young enough to be
+// changed by its sender
+func withinEditWindow(message models.Message) bool {
+	window := messageEditWindow()
+	return window <= 0 || time.Since(message.CreatedAt) <= window
+}
+
+// EditMessage replaces the text of a message, keeping the previous text in
+// its edit history
+func EditMessage(c *fiber.Ctx) error {
+	var req struct {
+		Text string `json:"text"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	messageID, err := strconv.Atoi(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	message, err := loadMessageForUser(uint(messageID), claims.ID)
+	if err != nil {
+		return messageLookupError(c, err)
+	}
+
+	if message.SenderID != claims.ID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the sender can edit a message",
+		})
+	}
+	if message.DeletedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Message has been deleted",
+		})
+	}
+	if !withinEditWindow(message) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Message can no longer be edited",
+		})
+	}
+	if strings.TrimSpace(req.Text) == "" && message.Image == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Message text is required",
+		})
+	}
+	if req.Text == message.Text {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": message,
+		})
+	}
+
+	editedAt := time.Now()
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.MessageEdit{
+			MessageID: message.ID,
+			Text:      message.Text,
+		}).Error; err != nil {
+			return err
+		}
+		// The preview is fetched again for the new text
+		return tx.Model(&message).Updates(map[string]interface{}{
+			"text":            req.Text,
+			"edited_at":       editedAt,
+			"link_preview_id": nil,
+		}).Error
+	})
+	if err != nil {
+		log.Println("Error editing message:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to edit message",
+		})
+	}
+	message.Text = req.Text
+	message.EditedAt = &editedAt
+	message.LinkPreviewID = nil
+
+	emitToParticipants(message, fiber.Map{
+		"event":   "messageEdited",
+		"message": message,
+	})
+	scheduleLinkPreview(message)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+// GetMessageEdits returns the previous versions of a message, oldest first
+func GetMessageEdits(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	messageID, err := strconv.Atoi(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	if _, err := loadMessageForUser(uint(messageID), claims.ID); err != nil {
+		return messageLookupError(c, err)
+	}
+
+	var edits []models.MessageEdit
+	if err := database.DB.Where("message_id = ?", messageID).
+		Order("id ASC").Find(&edits).Error; err != nil {
+		log.Println("Error fetching message edits:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"edits": edits,
+	})
+}
+
+// DeleteMessage deletes a message. With ?scope=everyone (sender only, within
+// the edit window) its content is wiped for all participants; the default
+// scope "me" only hides it for the caller.
+func DeleteMessage(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	messageID, err := strconv.Atoi(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	scope := c.Query("scope", "me")
+	if scope != "me" && scope != "everyone" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Scope must be either me or everyone",
+		})
+	}
+
+	message, err := loadMessageForUser(uint(messageID), claims.ID)
+	if err != nil {
+		return messageLookupError(c, err)
+	}
+
+	if scope == "me" {
+		deletion := models.MessageDeletion{MessageID: message.ID, UserID: claims.ID}
+		if err := database.DB.Where(deletion).FirstOrCreate(&deletion).Error; err != nil {
+			log.Println("Error deleting message:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to delete message",
+			})
+		}
+
+		// Only the caller's other devices need to drop it
+		utils.EmitToUser(claims.ID, fiber.Map{
+			"event":          "messageDeleted",
+			"scope":          scope,
+			"messageId":      message.ID,
+			"conversationId": message.ConversationID,
+		})
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"messageId": message.ID,
+			"scope":     scope,
+		})
+	}
+
+	if message.SenderID != claims.ID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the sender can delete a message for everyone",
+		})
+	}
+	if !withinEditWindow(message) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Message can no longer be deleted for everyone",
+		})
+	}
+
+	if message.DeletedAt == nil {
+		deletedAt := time.Now()
+		imageKeys := message.ImageKeys
+		var attachments []models.Attachment
+		err = database.DB.Transaction(func(tx *gorm.DB) error {
+			// Previous versions would otherwise still expose the content
+			if err := tx.Where("message_id = ?", message.ID).
+				Delete(&models.MessageEdit{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("message_id = ?", message.ID).
+				Delete(&models.MessageReaction{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Clauses(clause.Returning{}).Where("message_id = ?", message.ID).
+				Delete(&attachments).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&message).Updates(map[string]interface{}{
+				"text":            "",
+				"image":           "",
+				"image_preview":   "",
+				"image_thumbnail": "",
+				"image_keys":      nil,
+				"link_preview_id": nil,
+				"deleted_at":      deletedAt,
+			}).Error; err != nil {
+				return err
+			}
+			// A deleted reply no longer counts towards its thread
+			if message.ParentID == nil {
+				return nil
+			}
+			return tx.Model(&models.Message{}).Where("id = ?", *message.ParentID).
+				Update("reply_count", gorm.Expr("GREATEST(reply_count - 1, 0)")).Error
+		})
+		if err != nil {
+			log.Println("Error deleting message:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to delete message",
+			})
+		}
+		message.DeletedAt = &deletedAt
+		// The files go once nothing refers to them any more
+		deleteStoredAttachments(context.Background(), attachments)
+		utils.DeleteImageKeys(context.Background(), imageKeys...)
+	}
+
+	emitToParticipants(message, fiber.Map{
+		"event":          "messageDeleted",
+		"scope":          scope,
+		"messageId":      message.ID,
+		"conversationId": message.ConversationID,
+		"parentId":       message.ParentID,
+	})
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"messageId": message.ID,
+		"scope":     scope,
+	})
+}
+
+// emitToParticipants pushes an event to everyone who can see the message
+func emitToParticipants(message models.Message, payload fiber.Map) {
+	participants, err := messageParticipants(message)
+	if err != nil {
+		log.Println("Error fetching message participants:", err)
+		return
+	}
+	utils.EmitToUsers(participants, payload)
+}
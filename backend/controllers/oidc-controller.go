@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// The cookie holding the login state while the browser is at the provider
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStatePath   = "/api/auth/oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+var errSSOEmailUnverified = errors.New("identity provider did not verify the email address")
+
+// errSSOAccountUnverified is returned when the email belongs to a local
+// account whose address was never verified. Whoever signed up with it may
+// not own it, and linking would let them keep access to the real owner's
+// account, so the owner must verify the address first.
+var errSSOAccountUnverified = errors.New("local account with this email is not verified")
+
+// OIDCLogin starts single sign-on: it remembers the login state in a cookie
+// and redirects to the identity provider
+func OIDCLogin(c *fiber.Ctx) error {
+	provider := utils.SSOProvider
+	if provider == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": utils.ErrOIDCNotConfigured.Error(),
+		})
+	}
+
+	state := utils.OIDCState{
+		State:        utils.GenerateToken(24),
+		Nonce:        utils.GenerateToken(24),
+		CodeVerifier: utils.GenerateToken(48),
+	}
+
+	authURL, err := provider.AuthCodeURL(c.Context(), state.State, state.Nonce,
+		utils.PKCEChallenge(state.CodeVerifier))
+	if err != nil {
+		log.Println("Error starting single sign-on:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "identity provider is unavailable",
+		})
+	}
+
+	stateToken, err := utils.CreateOIDCStateToken(state, oidcStateTTL)
+	if err != nil {
+		log.Println("Error creating login state:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not start single sign-on",
+		})
+	}
+	setOIDCStateCookie(c, stateToken, time.Now().Add(oidcStateTTL))
+
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// OIDCCallback finishes single sign-on when the provider redirects back. The
+// browser ends up on the frontend either signed in, with a challengeToken for
+// the two-factor step, or with an error code.
+func OIDCCallback(c *fiber.Ctx) error {
+	provider := utils.SSOProvider
+	if provider == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": utils.ErrOIDCNotConfigured.Error(),
+		})
+	}
+
+	// The state is single use
+	stateToken := c.Cookies(oidcStateCookie)
+	setOIDCStateCookie(c, "", time.Now().Add(-24*time.Hour))
+
+	if c.Query("error") != "" {
+		return ssoFailure(c, "sso_cancelled")
+	}
+
+	state, err := utils.ValidateOIDCStateToken(stateToken)
+	if err != nil || c.Query("state") != state.State || c.Query("code") == "" {
+		return ssoFailure(c, "sso_invalid_state")
+	}
+
+	claims, err := provider.Exchange(c.Context(), c.Query("code"),
+		state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Println("Error completing single sign-on:", err)
+		return ssoFailure(c, "sso_failed")
+	}
+
+	user, err := findOrCreateSSOUser(provider.Name, claims)
+	if errors.Is(err, errSSOEmailUnverified) {
+		return ssoFailure(c, "sso_email_unverified")
+	}
+	if errors.Is(err, errSSOAccountUnverified) {
+		return ssoFailure(c, "sso_account_unverified")
+	}
+	if err != nil {
+		log.Println("Error signing in with single sign-on:", err)
+		return ssoFailure(c, "sso_failed")
+	}
+
+	// The provider replaces the password, not the second factor
+	if user.TwoFactorEnabled {
+		challengeToken, err := utils.CreateChallengeToken(user.ID)
+		if err != nil {
+			return ssoFailure(c, "sso_failed")
+		}
+		return c.Redirect(clientLink("/login", url.Values{
+			"challengeToken": {challengeToken},
+		}), fiber.StatusFound)
+	}
+
+	recordLoginAttempt(c, normalizeEmail(user.Email), &user.ID, models.LoginReasonSuccess)
+	if _, err := utils.StartSession(c, user); err != nil {
+		log.Println("Error starting session:", err)
+		return ssoFailure(c, "sso_failed")
+	}
+
+	return c.Redirect(os.Getenv("CLIENT_URL")+"/", fiber.StatusFound)
+}
+
+// GetIdentities lists the external accounts linked to the user
+func GetIdentities(c *fiber.Ctx) error {
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	var identities []models.UserIdentity
+	if err := database.DB.Where("user_id = ?", user.ID).
+		Order("id ASC").Find(&identities).Error; err != nil {
+		log.Println("Error fetching identities:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"identities": identities,
+	})
+}
+
+// findOrCreateSSOUser resolves the provider account to a user. Unknown
+// accounts are linked to the user with the same email address, or get a new
+// user, but only if the provider verified that address, and the existing
+// user did too.
+func findOrCreateSSOUser(provider string, claims utils.OIDCClaims) (models.User, error) {
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var identity models.UserIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider, claims.Subject).
+			First(&identity).Error
+		if err == nil {
+			return tx.First(&user, identity.UserID).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := normalizeEmail(claims.Email)
+		if email == "" || !claims.EmailVerified {
+			return errSSOEmailUnverified
+		}
+
+		err = tx.Where("LOWER(email) = ?", email).First(&user).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if user, err = newSSOUser(email, claims.Name); err != nil {
+				return err
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case user.EmailVerifiedAt == nil:
+			return errSSOAccountUnverified
+		}
+
+		return tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    email,
+		}).Error
+	})
+	return user, err
+}
+
+// newSSOUser builds a user signing up through the identity provider. The
+// password is random and unknown to anyone; it can be set with the
+// password reset flow.
+func newSSOUser(email, name string) (models.User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(utils.GenerateToken(32)),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+
+	now := time.Now()
+	return models.User{
+		Email:           email,
+		FullName:        name,
+		Password:        string(hashedPassword),
+		EmailVerifiedAt: &now,
+	}, nil
+}
+
+// ssoFailure sends the browser back to the login page with an error code
+func ssoFailure(c *fiber.Ctx, code string) error {
+	return c.Redirect(clientLink("/login", url.Values{"error": {code}}),
+		fiber.StatusFound)
+}
+
+func setOIDCStateCookie(c *fiber.Ctx, value string, expires time.Time) {
+	// Determine cookie security based on environment
+	isProduction := os.Getenv("ENV_KEY") == "production"
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     oidcStatePath,
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   isProduction,
+		// Lax, since the provider's redirect back is a cross-site navigation
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
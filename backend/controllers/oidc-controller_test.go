@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/chat-app/utils/oidctest"
+	"github.com/gofiber/fiber/v2"
+)
+
+const testClientURL = "http://client.test"
+
+// setupSSO wires the app to a mock identity provider and a test database
+func setupSSO(t *testing.T) (*oidctest.Provider, *fiber.App) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("CLIENT_URL", testClientURL)
+	if _, err := utils.InitializeTokenService(); err != nil {
+		t.Fatal(err)
+	}
+	databasetest.Open(t, &models.User{}, &models.UserIdentity{}, &models.Session{},
+		&models.LoginAttempt{})
+
+	idp := oidctest.NewProvider(t, "chat-app")
+	previous := utils.SSOProvider
+	utils.SSOProvider = &utils.OIDCProvider{
+		Name:        "oidc",
+		Issuer:      idp.Issuer(),
+		ClientID:    "chat-app",
+		RedirectURL: "http://app.test/api/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+		HTTPClient:  &http.Client{Timeout: 5 * time.Second},
+	}
+	t.Cleanup(func() { utils.SSOProvider = previous })
+
+	app := fiber.New()
+	app.Get("/api/auth/oidc/login", OIDCLogin)
+	app.Get("/api/auth/oidc/callback", OIDCCallback)
+	return idp, app
+}
+
+// ssoSignIn runs the whole flow and returns where the browser ends up
+func ssoSignIn(t *testing.T, idp *oidctest.Provider, app *fiber.App) string {
+	t.Helper()
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("login: %v, status %v", err, resp.StatusCode)
+	}
+	var stateCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcStateCookie {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil {
+		t.Fatal("login did not set the state cookie")
+	}
+
+	callback, err := idp.Authorize(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	req.AddCookie(stateCookie)
+	resp, err = app.Test(req, 10_000)
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback: %v, status %v", err, resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+func createUser(t *testing.T, email string, verified bool) models.User {
+	t.Helper()
+	user := models.User{Email: email, FullName: "Existing", Password: "x"}
+	if verified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func identities(t *testing.T) []models.UserIdentity {
+	t.Helper()
+	var identities []models.UserIdentity
+	if err := database.DB.Find(&identities).Error; err != nil {
+		t.Fatal(err)
+	}
+	return identities
+}
+
+func TestOIDCCallbackCreatesUser(t *testing.T) {
+	idp, app := setupSSO(t)
+
+	if location := ssoSignIn(t, idp, app); location != testClientURL+"/" {
+		t.Fatalf("redirected to %q", location)
+	}
+
+	var user models.User
+	if err := database.DB.Where("email = ?", "user@example.com").First(&user).Error; err != nil {
+		t.Fatalf("user not created: %v", err)
+	}
+	if user.EmailVerifiedAt == nil {
+		t.Error("new user's email is not marked verified")
+	}
+	if got := identities(t); len(got) != 1 || got[0].UserID != user.ID ||
+		got[0].Subject != "subject-1" {
+		t.Fatalf("identities = %+v", got)
+	}
+}
+
+func TestOIDCCallbackLinksVerifiedEmail(t *testing.T) {
+	idp, app := setupSSO(t)
+	existing := createUser(t, "User@Example.com", true)
+
+	if location := ssoSignIn(t, idp, app); location != testClientURL+"/" {
+		t.Fatalf("redirected to %q", location)
+	}
+
+	if got := identities(t); len(got) != 1 || got[0].UserID != existing.ID {
+		t.Fatalf("identities = %+v, want one linked to user %d", got, existing.ID)
+	}
+
+	// Later sign-ins find the user through the identity, whatever the email
+	idp.Account.Email = "renamed@example.com"
+	idp.Account.EmailVerified = false
+	if location := ssoSignIn(t, idp, app); location != testClientURL+"/" {
+		t.Fatalf("second sign-in redirected to %q", location)
+	}
+	if got := identities(t); len(got) != 1 {
+		t.Fatalf("second sign-in created another identity: %+v", got)
+	}
+}
+
+func TestOIDCCallbackRefusesUnverifiedEmail(t *testing.T) {
+	idp, app := setupSSO(t)
+	createUser(t, "user@example.com", true)
+	idp.Account.EmailVerified = false
+
+	location := ssoSignIn(t, idp, app)
+	if !strings.Contains(location, "error=sso_email_unverified") {
+		t.Fatalf("redirected to %q, want the unverified email error", location)
+	}
+	if got := identities(t); len(got) != 0 {
+		t.Fatalf("account was linked: %+v", got)
+	}
+	var sessions int64
+	database.DB.Model(&models.Session{}).Count(&sessions)
+	if sessions != 0 {
+		t.Fatal("a session was started")
+	}
+}
+
+// Whoever signed up with an address they never verified may not own it, so
+// the owner signing in must not be handed their account
+func TestOIDCCallbackRefusesUnverifiedAccount(t *testing.T) {
+	idp, app := setupSSO(t)
+	existing := createUser(t, "user@example.com", false)
+
+	location := ssoSignIn(t, idp, app)
+	if !strings.Contains(location, "error=sso_account_unverified") {
+		t.Fatalf("redirected to %q, want the unverified account error", location)
+	}
+	if got := identities(t); len(got) != 0 {
+		t.Fatalf("account was linked: %+v", got)
+	}
+	var sessions int64
+	database.DB.Model(&models.Session{}).Count(&sessions)
+	if sessions != 0 {
+		t.Fatal("a session was started")
+	}
+	var user models.User
+	database.DB.First(&user, existing.ID)
+	if user.EmailVerifiedAt != nil {
+		t.Error("the account's email was marked verified")
+	}
+}
+
+func TestOIDCCallbackRejectsInvalidIDToken(t *testing.T) {
+	idp, app := setupSSO(t)
+	idp.TokenAudience = "another-client"
+
+	location := ssoSignIn(t, idp, app)
+	if !strings.Contains(location, "error=sso_failed") {
+		t.Fatalf("redirected to %q, want a failure", location)
+	}
+	if got := identities(t); len(got) != 0 {
+		t.Fatalf("identities = %+v", got)
+	}
+}
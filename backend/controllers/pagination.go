@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// cursorPage is a page request keyed on message IDs. Without a cursor the
+// latest messages are returned; "before" walks back through older history
+// and "after" fetches anything newer than a known message.
+type cursorPage struct {
+	Before uint
+	After  uint
+	Limit  int
+}
+
+// parseCursorPage reads the before, after and limit query parameters
+func parseCursorPage(c *fiber.Ctx) (cursorPage, error) {
+	page := cursorPage{Limit: defaultPageSize}
+
+	if before := c.Query("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			return page, errors.New("invalid before cursor")
+		}
+		page.Before = uint(id)
+	}
+
+	if after := c.Query("after"); after != "" {
+		id, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return page, errors.New("invalid after cursor")
+		}
+		page.After = uint(id)
+	}
+
+	if page.Before != 0 && page.After != 0 {
+		return page, errors.New("use either before or after, not both")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return page, errors.New("invalid limit")
+		}
+		page.Limit = min(n, maxPageSize)
+	}
+
+	return page, nil
+}
+
+// paginateMessages runs a message query for one page. Messages are returned
+// oldest first; nextCursor is the ID to pass as the same cursor parameter
+// to continue in that direction, or nil once there is nothing left.
+func paginateMessages(query *gorm.DB, page cursorPage) ([]models.Message, *uint, error) {
+	var messages []models.Message
+
+	if page.After != 0 {
+		err := query.Where("messages.id > ?", page.After).
+			Order("messages.id ASC").Limit(page.Limit + 1).
+			Find(&messages).Error
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(messages) <= page.Limit {
+			return messages, nil, nil
+		}
+		messages = messages[:page.Limit]
+		return messages, &messages[len(messages)-1].ID, nil
+	}
+
+	if page.Before != 0 {
+		query = query.Where("messages.id < ?", page.Before)
+	}
+	err := query.Order("messages.id DESC").Limit(page.Limit + 1).
+		Find(&messages).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hasMore := len(messages) > page.Limit
+	if hasMore {
+		messages = messages[:page.Limit]
+	}
+
+	// Flip to chronological order for display
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	if !hasMore {
+		return messages, nil, nil
+	}
+	return messages, &messages[0].ID, nil
+}
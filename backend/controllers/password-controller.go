@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const minPasswordLength = 6
+
+// passwordResetTTL is how long a reset link stays valid
+// (PASSWORD_RESET_TTL, default 1h)
+func passwordResetTTL() time.Duration {
+	return utils.GetEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+}
+
+// Minimum time between two reset emails for the same account
+const passwordResetCooldown = time.Minute
+
+// ForgotPassword emails a password reset link. The response is the same
+// whether or not the email belongs to an account, and is sent before the
+// account is even looked up so its timing reveals nothing either.
+func ForgotPassword(c *fiber.Ctx) error {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.BodyParser(&req); err != nil || req.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "email is required",
+		})
+	}
+
+	go sendPasswordResetEmail(normalizeEmail(req.Email))
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "if an account exists for this email, a reset link has been sent",
+	})
+}
+
+// sendPasswordResetEmail mails a reset link to the account using the email,
+// if there is one. It runs off the request path, so errors are only logged.
+func sendPasswordResetEmail(email string) {
+	var user models.User
+	if err := database.DB.Where("LOWER(email) = ? AND type <> ?", email,
+		models.UserTypeBot).Order("id").First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Error fetching user for password reset:", err)
+		}
+		return
+	}
+
+	// Quietly skip repeated requests so the endpoint cannot flood an inbox
+	latest, err := utils.LatestUserToken(user.ID, models.TokenPurposePasswordReset)
+	if err == nil && time.Since(latest.CreatedAt) < passwordResetCooldown {
+		return
+	}
+
+	token, err := utils.IssueUserToken(user.ID, models.TokenPurposePasswordReset,
+		passwordResetTTL())
+	if err != nil {
+		log.Println("Error issuing password reset token:", err)
+		return
+	}
+
+	link := clientLink("/reset-password", url.Values{"token": {token}})
+	if err := utils.AppMailer.Send(context.Background(), utils.Email{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. "+
+			"To choose a new password, open this link:\n\n%s\n\n"+
+			"The link can be used once and expires in %s. If this wasn't you, you can ignore this email.\n",
+			user.FullName, link, passwordResetTTL()),
+	}); err != nil {
+		log.Println("Error sending password reset email:", err)
+	}
+}
+
+// ResetPassword sets a new password using the token from a reset link, signs
+// the account out everywhere and revokes its personal access tokens, since a
+// reset usually means someone else had access
+func ResetPassword(c *fiber.Ctx) error {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "reset token is required",
+		})
+	}
+
+	if len(req.Password) < minPasswordLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("password should be at least %d characters", minPasswordLength),
+		})
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not save the password",
+		})
+	}
+
+	var userID uint
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		userToken, err := utils.ConsumeUserToken(tx, req.Token,
+			models.TokenPurposePasswordReset)
+		if err != nil {
+			return err
+		}
+		userID = userToken.UserID
+
+		// Following the emailed link also proves the address is theirs
+		return tx.Model(&models.User{ID: userID}).Updates(map[string]interface{}{
+			"password":          string(passwordHash),
+			"email_verified_at": gorm.Expr("COALESCE(email_verified_at, ?)", time.Now()),
+		}).Error
+	})
+	if err != nil {
+		if errors.Is(err, utils.ErrUserTokenInvalid) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "reset link is invalid or has expired",
+			})
+		}
+		log.Println("Error resetting password:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not reset password",
+		})
+	}
+
+	if err := utils.RevokeOtherSessions(userID, 0); err != nil {
+		log.Println("Error revoking sessions after password reset:", err)
+	}
+	if err := utils.RevokePersonalAccessTokens(userID); err != nil {
+		log.Println("Error revoking access tokens after password reset:", err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "password has been reset, please log in",
+	})
+}
+
+// ChangePassword replaces the logged-in user's password after checking the
+// current one, and signs out every other device. With revokeAccessTokens
+// set, the user's personal access tokens are revoked as well.
+func ChangePassword(c *fiber.Ctx) error {
+	var req struct {
+		CurrentPassword    string `json:"currentPassword"`
+		NewPassword        string `json:"newPassword"`
+		RevokeAccessTokens bool   `json:"revokeAccessTokens"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid input",
+		})
+	}
+
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+	session, _ := c.Locals("session").(models.Session)
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "current and new password are required",
+		})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password),
+		[]byte(req.CurrentPassword)); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "current password is incorrect",
+		})
+	}
+
+	if len(req.NewPassword) < minPasswordLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("password should be at least %d characters", minPasswordLength),
+		})
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not save the password",
+		})
+	}
+
+	if err := database.DB.Model(&user).
+		Update("password", string(passwordHash)).Error; err != nil {
+		log.Println("Error changing password:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not change password",
+		})
+	}
+
+	if err := utils.RevokeOtherSessions(user.ID, session.ID); err != nil {
+		log.Println("Error revoking sessions after password change:", err)
+	}
+	if req.RevokeAccessTokens {
+		if err := utils.RevokePersonalAccessTokens(user.ID); err != nil {
+			log.Println("Error revoking access tokens after password change:", err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "password changed",
+	})
+}
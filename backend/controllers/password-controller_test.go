@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// recordingMailer hands sent emails to the test
+type recordingMailer struct {
+	sent chan utils.Email
+}
+
+func (m recordingMailer) Send(ctx context.Context, email utils.Email) error {
+	m.sent <- email
+	return nil
+}
+
+func useRecordingMailer(t *testing.T) recordingMailer {
+	t.Helper()
+	mailer := recordingMailer{sent: make(chan utils.Email, 10)}
+	previous := utils.AppMailer
+	utils.AppMailer = mailer
+	t.Cleanup(func() { utils.AppMailer = previous })
+	return mailer
+}
+
+func (m recordingMailer) next(t *testing.T) utils.Email {
+	t.Helper()
+	select {
+	case email := <-m.sent:
+		return email
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return utils.Email{}
+	}
+}
+
+var resetLinkPattern = regexp.MustCompile(`\S*/reset-password\?\S+`)
+
+func postJSON(t *testing.T, app *fiber.App, path, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func setupPasswordReset(t *testing.T) (models.User, recordingMailer, *fiber.App) {
+	t.Helper()
+	t.Setenv("CLIENT_URL", testClientURL)
+	databasetest.Open(t, &models.User{}, &models.UserToken{}, &models.Session{},
+		&models.PersonalAccessToken{})
+	mailer := useRecordingMailer(t)
+
+	user := createUser(t, "user@example.com", true)
+
+	app := fiber.New()
+	app.Post("/api/auth/forgot-password", ForgotPassword)
+	app.Post("/api/auth/reset-password", ResetPassword)
+	return user, mailer, app
+}
+
+func TestPasswordReset(t *testing.T) {
+	user, mailer, app := setupPasswordReset(t)
+
+	session := models.Session{UserID: user.ID, RefreshTokenHash: "hash",
+		ExpiresAt: time.Now().Add(time.Hour)}
+	database.DB.Create(&session)
+	accessToken, _, err := utils.IssuePersonalAccessToken(user.ID, "script",
+		[]string{models.ScopeMessagesRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Addresses are matched like at login, whatever their case
+	if status := postJSON(t, app, "/api/auth/forgot-password",
+		`{"email": " User@Example.COM "}`); status != http.StatusOK {
+		t.Fatalf("forgot password: status %d", status)
+	}
+	email := mailer.next(t)
+	if email.To != user.Email {
+		t.Fatalf("reset email sent to %q", email.To)
+	}
+	link, err := url.Parse(resetLinkPattern.FindString(email.Body))
+	if err != nil || link.Query().Get("token") == "" {
+		t.Fatalf("no reset link in %q", email.Body)
+	}
+	body := `{"token": "` + link.Query().Get("token") + `", "password": "new-password"}`
+
+	if status := postJSON(t, app, "/api/auth/reset-password", body); status != http.StatusOK {
+		t.Fatalf("reset password: status %d", status)
+	}
+	if status := postJSON(t, app, "/api/auth/reset-password", body); status != http.StatusBadRequest {
+		t.Fatalf("reset link used twice: status %d", status)
+	}
+
+	// A reset usually means someone else had access
+	database.DB.First(&session, session.ID)
+	if session.Active() {
+		t.Error("session still active after the password reset")
+	}
+	if _, err := utils.AuthenticatePersonalAccessToken(accessToken); err == nil {
+		t.Error("personal access token still works after the password reset")
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	_, mailer, _ := setupPasswordReset(t)
+
+	// What ForgotPassword runs after answering
+	sendPasswordResetEmail("nobody@example.com")
+	select {
+	case email := <-mailer.sent:
+		t.Fatalf("email sent for an unknown address: %+v", email)
+	default:
+	}
+}
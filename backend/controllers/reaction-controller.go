@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm/clause"
+)
+
+// Longest accepted emoji; sequences joined with ZWJ take several code points
+const maxEmojiRunes = 16
+
+// AddReaction reacts to a message with an emoji
+func AddReaction(c *fiber.Ctx) error {
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	return changeReaction(c, req.Emoji, true)
+}
+
+// RemoveReaction takes back the caller's reaction (?emoji=...) to a message
+func RemoveReaction(c *fiber.Ctx) error {
+	return changeReaction(c, c.Query("emoji"), false)
+}
+
+// changeReaction adds or removes a reaction and tells the participants
+func changeReaction(c *fiber.Ctx, emoji string, add bool) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	messageID, err := strconv.Atoi(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	emoji = strings.TrimSpace(emoji)
+	if !validEmoji(emoji) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A single emoji is required",
+		})
+	}
+
+	message, err := loadMessageForUser(uint(messageID), claims.ID)
+	if err != nil {
+		return messageLookupError(c, err)
+	}
+	if message.DeletedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Message has been deleted",
+		})
+	}
+
+	reaction := models.MessageReaction{
+		MessageID: message.ID,
+		UserID:    claims.ID,
+		Emoji:     emoji,
+	}
+	var changed int64
+	if add {
+		result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+		err, changed = result.Error, result.RowsAffected
+	} else {
+		result := database.DB.Where("message_id = ? AND user_id = ? AND emoji = ?",
+			message.ID, claims.ID, emoji).Delete(&models.MessageReaction{})
+		err, changed = result.Error, result.RowsAffected
+	}
+	if err != nil {
+		log.Println("Error updating reaction:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update reaction",
+		})
+	}
+
+	var count int64
+	if err := database.DB.Model(&models.MessageReaction{}).
+		Where("message_id = ? AND emoji = ?", message.ID, emoji).
+		Count(&count).Error; err != nil {
+		log.Println("Error counting reactions:", err)
+	}
+
+	// Repeating an add or remove changes nothing and announces nothing
+	if changed > 0 {
+		event := "reactionRemoved"
+		if add {
+			event = "reactionAdded"
+		}
+		emitToParticipants(message, fiber.Map{
+			"event":          event,
+			"messageId":      message.ID,
+			"conversationId": message.ConversationID,
+			"userId":         claims.ID,
+			"emoji":          emoji,
+			"count":          count,
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"messageId": message.ID,
+		"emoji":     emoji,
+		"count":     count,
+		"reacted":   add,
+	})
+}
+
+// attachReactions fills in the aggregated reactions of the messages, as
+// seen by the user
+func attachReactions(messages []models.Message, userID uint) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	var rows []struct {
+		MessageID uint
+		models.ReactionCount
+	}
+	if err := database.DB.Model(&models.MessageReaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS reacted", userID).
+		Where("message_id IN ?", ids).
+		Group("message_id, emoji").
+		// Emojis keep the order in which they were first used
+		Order("MIN(id)").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	byMessage := make(map[uint][]models.ReactionCount)
+	for _, row := range rows {
+		byMessage[row.MessageID] = append(byMessage[row.MessageID], row.ReactionCount)
+	}
+	for i := range messages {
+		messages[i].Reactions = byMessage[messages[i].ID]
+	}
+	return nil
+}
+
+// validEmoji accepts a short run of symbols without spaces or plain text,
+// which covers single emojis including modifier and ZWJ sequences
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > 64 || !utf8.ValidString(emoji) ||
+		utf8.RuneCountInString(emoji) > maxEmojiRunes {
+		return false
+	}
+
+	nonASCII := false
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) {
+			return false
+		}
+		if r > unicode.MaxASCII {
+			nonASCII = true
+		}
+	}
+	return nonASCII
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		valid bool
+	}{
+		{"👍", true},
+		{"❤️", true},      // with variation selector
+		{"👍🏽", true},      // skin tone modifier
+		{"👩‍💻", true},     // ZWJ sequence
+		{"👨‍👩‍👧‍👦", true}, // long ZWJ sequence
+		{"🇫🇷", true},      // flag, two regional indicators
+		{"1️⃣", true},     // keycap
+		{"", false},
+		{"a", false},
+		{":)", false},                    // ASCII only
+		{"ok👍", false},                   // letters
+		{"é", false},                     // a letter, not a symbol
+		{"👍 👍", false},                   // space
+		{"👍\n", false},                   // control character
+		{"\xff", false},                  // invalid UTF-8
+		{strings.Repeat("👍", 20), false}, // too long
+	}
+
+	for _, tt := range tests {
+		if got := validEmoji(tt.emoji); got != tt.valid {
+			t.Errorf("validEmoji(%q) = %v, want %v", tt.emoji, got, tt.valid)
+		}
+	}
+}
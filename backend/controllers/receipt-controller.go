@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// readTarget identifies the chat being marked read: a peer for direct
+// messages or a group conversation
+type readTarget struct {
+	PeerID         uint `json:"peerId"`
+	ConversationID uint `json:"conversationId"`
+	// MessageID is the newest message the reader has seen
+	MessageID uint `json:"messageId"`
+}
+
+// MarkMessagesRead marks a chat read up to a message ID. It is routed both
+// for direct chats (/api/messages/read/:id) and groups
+// (/api/conversations/:conversationId/read).
+func MarkMessagesRead(c *fiber.Ctx) error {
+	var req struct {
+		MessageID uint `json:"messageId"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	target := readTarget{MessageID: req.MessageID}
+	if conversationIDParam := c.Params("conversationId"); conversationIDParam != "" {
+		conversationID, err := strconv.Atoi(conversationIDParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid conversation ID",
+			})
+		}
+		target.ConversationID = uint(conversationID)
+	} else {
+		peerID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+		target.PeerID = uint(peerID)
+	}
+
+	readAt, err := markRead(claims.ID, target)
+	if err != nil {
+		if errors.Is(err, errNotMember) {
+			return membershipError(c, err)
+		}
+		if errors.Is(err, errInvalidReadTarget) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if errors.Is(err, errMessageNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Message not found",
+			})
+		}
+		log.Println("Error marking messages read:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to mark messages as read",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"messageId": target.MessageID,
+		"readAt":    readAt,
+	})
+}
+
+// MarkReadSocketEvent handles the "markRead" WebSocket client event:
+// {"event": "markRead", "peerId" | "conversationId": ..., "messageId": ...}
+func MarkReadSocketEvent(userID uint, data []byte) error {
+	var target readTarget
+	if err := json.Unmarshal(data, &target); err != nil {
+		return errInvalidReadTarget
+	}
+
+	if _, err := markRead(userID, target); err != nil {
+		if errors.Is(err, errNotMember) || errors.Is(err, errInvalidReadTarget) ||
+			errors.Is(err, errMessageNotFound) {
+			return err
+		}
+		log.Println("Error marking messages read:", err)
+		return errors.New("failed to mark messages as read")
+	}
+	return nil
+}
+
+var errInvalidReadTarget = errors.New("a peer or conversation and a message ID are required")
+
+// markRead records that reader has read the chat up to target.MessageID and
+// pushes a "messageRead" event to whoever needs to update their ticks
+func markRead(readerID uint, target readTarget) (time.Time, error) {
+	readAt := time.Now()
+
+	if target.MessageID == 0 ||
+		(target.PeerID == 0) == (target.ConversationID == 0) {
+		return readAt, errInvalidReadTarget
+	}
+
+	if target.ConversationID != 0 {
+		member, err := getMembership(target.ConversationID, readerID)
+		if err != nil {
+			return readAt, err
+		}
+
+		// The read pointer must name a message of this group, or a client
+		// could jump it past messages not sent yet
+		var exists bool
+		err = database.DB.Model(&models.Message{}).Select("count(*) > 0").
+			Where("id = ? AND conversation_id = ?", target.MessageID, target.ConversationID).
+			Find(&exists).Error
+		if err != nil {
+			return readAt, err
+		}
+		if !exists {
+			return readAt, errMessageNotFound
+		}
+
+		// Never move the read pointer backwards
+		result := database.DB.Model(&member).
+			Where("last_read_message_id IS NULL OR last_read_message_id < ?", target.MessageID).
+			Update("last_read_message_id", target.MessageID)
+		if result.Error != nil {
+			return readAt, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return readAt, nil
+		}
+
+		memberIDs, err := conversationMemberIDs(target.ConversationID)
+		if err != nil {
+			return readAt, err
+		}
+		utils.EmitToUsers(memberIDs, fiber.Map{
+			"event":          "messageRead",
+			"conversationId": target.ConversationID,
+			"readerId":       readerID,
+			"messageId":      target.MessageID,
+			"readAt":         readAt,
+		})
+		return readAt, nil
+	}
+
+	var updated []models.Message
+	err := database.DB.Model(&updated).Clauses(clause.Returning{
+		Columns: []clause.Column{{Name: "id"}},
+	}).Where(
+		"sender_id = ? AND receiver_id = ? AND conversation_id IS NULL AND id <= ? AND read_at IS NULL",
+		target.PeerID, readerID, target.MessageID,
+	).Updates(map[string]interface{}{
+		"read_at":      readAt,
+		"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", readAt),
+	}).Error
+	if err != nil {
+		return readAt, err
+	}
+	if len(updated) == 0 {
+		return readAt, nil
+	}
+
+	messageIDs := make([]uint, 0, len(updated))
+	for _, message := range updated {
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	// The reader's other devices clear their unread state as well
+	utils.EmitToUsers([]uint{target.PeerID, readerID}, fiber.Map{
+		"event":      "messageRead",
+		"readerId":   readerID,
+		"senderId":   target.PeerID,
+		"messageIds": messageIDs,
+		"messageId":  target.MessageID,
+		"readAt":     readAt,
+	})
+	return readAt, nil
+}
+
+// MarkMessagesDelivered runs when a user connects and marks every direct
+// message still waiting for them as delivered, telling each sender
+func MarkMessagesDelivered(userID uint) {
+	deliveredAt := time.Now()
+
+	var updated []models.Message
+	err := database.DB.Model(&updated).Clauses(clause.Returning{
+		Columns: []clause.Column{{Name: "id"}, {Name: "sender_id"}},
+	}).Where(
+		"receiver_id = ? AND conversation_id IS NULL AND delivered_at IS NULL",
+		userID,
+	).Update("delivered_at", deliveredAt).Error
+	if err != nil {
+		log.Println("Error marking messages delivered:", err)
+		return
+	}
+
+	bySender := make(map[uint][]uint)
+	for _, message := range updated {
+		bySender[message.SenderID] = append(bySender[message.SenderID], message.ID)
+	}
+
+	for senderID, messageIDs := range bySender {
+		utils.EmitToUser(senderID, fiber.Map{
+			"event":       "messageDelivered",
+			"receiverId":  userID,
+			"messageIds":  messageIDs,
+			"deliveredAt": deliveredAt,
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// searchResult is a matching message with a highlighted excerpt. Matches in
+// the snippet are wrapped in <mark> tags and the rest of the text is HTML
+// escaped, so clients can render it as markup.
+type searchResult struct {
+	models.Message
+	Snippet string `json:"snippet"`
+}
+
+// snippetSQL builds the highlighted excerpt. The text is escaped before
+// ts_headline adds the <mark> tags.
+const snippetSQL = `ts_headline('simple',
+	replace(replace(replace(messages.text, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+	websearch_to_tsquery('simple', ?),
+	'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter= … ') AS snippet`
+
+// SearchMessages runs a full-text search over the messages of every chat the
+// logged-in user takes part in, newest first.
+//
+// Query parameters: q (required), peerId or conversationId to narrow down to
+// one chat, from/to (RFC 3339 or YYYY-MM-DD) and before/limit for paging.
+func SearchMessages(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+	userID := claims.ID
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Search query is required",
+		})
+	}
+
+	page, err := parseCursorPage(c)
+	if err != nil || page.After != 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid pagination parameters",
+		})
+	}
+
+	query := database.DB.Model(&models.Message{}).
+		Select("messages.*, "+snippetSQL, q).
+		Where("messages.text_search @@ websearch_to_tsquery('simple', ?)", q).
+		Where("messages.deleted_at IS NULL").
+		Scopes(notDeletedFor(userID))
+
+	if conversationIDParam := c.Query("conversationId"); conversationIDParam != "" {
+		conversationID, err := strconv.Atoi(conversationIDParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid conversation ID",
+			})
+		}
+		if _, err := getMembership(uint(conversationID), userID); err != nil {
+			return membershipError(c, err)
+		}
+		query = query.Where("messages.conversation_id = ?", conversationID)
+	} else if peerIDParam := c.Query("peerId"); peerIDParam != "" {
+		peerID, err := strconv.Atoi(peerIDParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid peer ID",
+			})
+		}
+		query = query.Where(
+			"messages.conversation_id IS NULL AND ((messages.sender_id = ? AND messages.receiver_id = ?) OR (messages.sender_id = ? AND messages.receiver_id = ?))",
+			userID, peerID, peerID, userID,
+		)
+	} else {
+		// Every direct chat of the user plus every group they belong to
+		query = query.Where(
+			"(messages.conversation_id IS NULL AND (messages.sender_id = ? OR messages.receiver_id = ?)) OR messages.conversation_id IN (?)",
+			userID, userID,
+			database.DB.Model(&models.ConversationMember{}).
+				Select("conversation_id").Where("user_id = ?", userID),
+		)
+	}
+
+	if from := c.Query("from"); from != "" {
+		fromTime, err := parseSearchTime(from)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from date",
+			})
+		}
+		query = query.Where("messages.created_at >= ?", fromTime)
+	}
+
+	if to := c.Query("to"); to != "" {
+		toTime, err := parseSearchTime(to)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to date",
+			})
+		}
+		// A bare date includes the whole day
+		if !strings.Contains(to, "T") {
+			toTime = toTime.AddDate(0, 0, 1)
+		}
+		query = query.Where("messages.created_at < ?", toTime)
+	}
+
+	if page.Before != 0 {
+		query = query.Where("messages.id < ?", page.Before)
+	}
+
+	var results []searchResult
+	if err := query.Order("messages.id DESC").Limit(page.Limit + 1).
+		Find(&results).Error; err != nil {
+		log.Println("Error searching messages:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	var nextCursor *uint
+	if len(results) > page.Limit {
+		results = results[:page.Limit]
+		nextCursor = &results[len(results)-1].ID
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"results":    results,
+		"nextCursor": nextCursor,
+	})
+}
+
+// parseSearchTime accepts either an RFC 3339 timestamp or a plain date
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RefreshHandler exchanges the refresh cookie for a new access token,
+// rotating the refresh token at the same time
+func RefreshHandler(c *fiber.Ctx) error {
+	token, err := utils.RefreshSession(c)
+	if err != nil {
+		if errors.Is(err, utils.ErrSessionInvalid) ||
+			errors.Is(err, utils.ErrRefreshTokenReused) {
+			utils.ClearAuthCookies(c)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Session has expired, please log in again",
+			})
+		}
+		log.Println("Error refreshing session:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh session",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"token": token,
+	})
+}
+
+// GetSessions lists the active sessions (signed-in devices) of the user
+func GetSessions(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+	current, _ := c.Locals("session").(models.Session)
+
+	var sessions []models.Session
+	if err := database.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", claims.ID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error; err != nil {
+		log.Println("Error fetching sessions:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	type sessionResponse struct {
+		models.Session
+		Current bool `json:"current"`
+	}
+	response := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionResponse{
+			Session: session,
+			Current: session.ID == current.ID,
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"sessions": response,
+	})
+}
+
+// RevokeSession signs out one of the user's devices
+func RevokeSession(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	sessionID, err := strconv.Atoi(c.Params("sessionId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid session ID",
+		})
+	}
+
+	if err := utils.RevokeSession(claims.ID, uint(sessionID)); err != nil {
+		if errors.Is(err, utils.ErrSessionInvalid) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Session not found",
+			})
+		}
+		log.Println("Error revoking session:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+
+	// Revoking the current session is a logout
+	if current, ok := c.Locals("session").(models.Session); ok &&
+		current.ID == uint(sessionID) {
+		utils.ClearAuthCookies(c)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Session revoked",
+	})
+}
+
+// RevokeOtherSessions signs out every device except the current one
+func RevokeOtherSessions(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+	current, _ := c.Locals("session").(models.Session)
+
+	if err := utils.RevokeOtherSessions(claims.ID, current.ID); err != nil {
+		log.Println("Error revoking sessions:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Other sessions revoked",
+	})
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Length of the quoted parent text, in characters
+const quotePreviewLength = 200
+
+var (
+	errParentNotFound = errors.New("the message replied to does not exist in this chat")
+	errParentDeleted  = errors.New("cannot reply to a deleted message")
+)
+
+// GetThread returns a message with its replies, oldest first, paginated
+// like GetMessages. Replies deleted for everyone are left out, as they are
+// from the reply count.
+func GetThread(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	messageID, err := strconv.Atoi(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	page, err := parseCursorPage(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	parent, err := loadMessageForUser(uint(messageID), claims.ID)
+	if err != nil {
+		return messageLookupError(c, err)
+	}
+
+	query := database.DB.Model(&models.Message{}).Scopes(notDeletedFor(claims.ID)).
+		Where("parent_id = ? AND deleted_at IS NULL", parent.ID)
+	replies, nextCursor, err := paginateMessages(query, page)
+	if err != nil {
+		log.Println("Error fetching thread:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	thread := append([]models.Message{parent}, replies...)
+	if err := attachReactions(thread, claims.ID); err != nil {
+		log.Println("Error fetching reactions:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if err := attachAttachments(thread); err != nil {
+		log.Println("Error fetching attachments:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if err := attachLinkPreviews(thread); err != nil {
+		log.Println("Error fetching link previews:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if err := attachParentQuotes(thread[:1]); err != nil {
+		log.Println("Error fetching quoted messages:", err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"parent":     thread[0],
+		"messages":   thread[1:],
+		"nextCursor": nextCursor,
+	})
+}
+
+// loadReplyParent checks that a reply's parent is visible to the sender and
+// belongs to the same chat as the reply
+func loadReplyParent(parentID uint, reply models.Message) (models.Message, error) {
+	parent, err := loadMessageForUser(parentID, reply.SenderID)
+	if errors.Is(err, errMessageNotFound) {
+		return parent, errParentNotFound
+	}
+	if err != nil {
+		return parent, err
+	}
+
+	if reply.ConversationID != nil {
+		if parent.ConversationID == nil || *parent.ConversationID != *reply.ConversationID {
+			return parent, errParentNotFound
+		}
+	} else {
+		sameChat := parent.ConversationID == nil &&
+			((parent.SenderID == reply.SenderID && parent.ReceiverID == reply.ReceiverID) ||
+				(parent.SenderID == reply.ReceiverID && parent.ReceiverID == reply.SenderID))
+		if !sameChat {
+			return parent, errParentNotFound
+		}
+	}
+
+	if parent.DeletedAt != nil {
+		return parent, errParentDeleted
+	}
+	return parent, nil
+}
+
+// quoteMessage shortens a message for display above a reply
+func quoteMessage(message models.Message) *models.MessageQuote {
+	text := []rune(message.Text)
+	if len(text) > quotePreviewLength {
+		text = text[:quotePreviewLength]
+	}
+	return &models.MessageQuote{
+		ID:         message.ID,
+		SenderID:   message.SenderID,
+		Text:       string(text),
+		HasImage:   message.Image != "",
+		Deleted:    message.DeletedAt != nil,
+		ReplyCount: message.ReplyCount,
+	}
+}
+
+// attachParentQuotes fills in the quoted parent of every reply. Parents
+// deleted for the user are still quoted; only deletion for everyone hides them.
+func attachParentQuotes(messages []models.Message) error {
+	var parentIDs []uint
+	for _, message := range messages {
+		if message.ParentID != nil {
+			parentIDs = append(parentIDs, *message.ParentID)
+		}
+	}
+	if len(parentIDs) == 0 {
+		return nil
+	}
+
+	var parents []models.Message
+	if err := database.DB.Where("id IN ?", uniqueIDs(parentIDs, 0)).
+		Find(&parents).Error; err != nil {
+		return err
+	}
+
+	quotes := make(map[uint]*models.MessageQuote, len(parents))
+	for _, parent := range parents {
+		quotes[parent.ID] = quoteMessage(parent)
+	}
+	for i := range messages {
+		if messages[i].ParentID != nil {
+			messages[i].Parent = quotes[*messages[i].ParentID]
+		}
+	}
+	return nil
+}
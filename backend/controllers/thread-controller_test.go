@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+)
+
+func createMessage(t *testing.T, message models.Message) models.Message {
+	t.Helper()
+	if err := database.DB.Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func createGroup(t *testing.T, name string, members ...models.User) uint {
+	t.Helper()
+	group := models.Conversation{Name: name, CreatedByID: members[0].ID}
+	if err := database.DB.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range members {
+		database.DB.Create(&models.ConversationMember{ConversationID: group.ID,
+			UserID: member.ID, Role: models.RoleMember})
+	}
+	return group.ID
+}
+
+func TestLoadReplyParent(t *testing.T) {
+	databasetest.Open(t, &models.User{}, &models.Conversation{},
+		&models.ConversationMember{}, &models.Message{})
+
+	alice := createUser(t, "alice@example.com", true)
+	bob := createUser(t, "bob@example.com", true)
+	carol := createUser(t, "carol@example.com", true)
+	team := createGroup(t, "Team", alice, bob)
+	other := createGroup(t, "Other", alice, carol)
+	private := createGroup(t, "Private", bob, carol)
+
+	now := time.Now()
+	fromAlice := createMessage(t, models.Message{SenderID: alice.ID, ReceiverID: bob.ID, Text: "hi"})
+	fromBob := createMessage(t, models.Message{SenderID: bob.ID, ReceiverID: alice.ID, Text: "hey"})
+	toCarol := createMessage(t, models.Message{SenderID: alice.ID, ReceiverID: carol.ID, Text: "hi"})
+	betweenOthers := createMessage(t, models.Message{SenderID: bob.ID, ReceiverID: carol.ID, Text: "psst"})
+	deleted := createMessage(t, models.Message{SenderID: bob.ID, ReceiverID: alice.ID, DeletedAt: &now})
+	inTeam := createMessage(t, models.Message{SenderID: bob.ID, ConversationID: &team, Text: "team"})
+	inOther := createMessage(t, models.Message{SenderID: carol.ID, ConversationID: &other, Text: "other"})
+	inPrivate := createMessage(t, models.Message{SenderID: bob.ID, ConversationID: &private, Text: "private"})
+
+	toBob := models.Message{SenderID: alice.ID, ReceiverID: bob.ID}
+	toTeam := models.Message{SenderID: alice.ID, ConversationID: &team}
+
+	tests := []struct {
+		name   string
+		reply  models.Message
+		parent uint
+		want   error
+	}{
+		{"own message in the same chat", toBob, fromAlice.ID, nil},
+		{"their message in the same chat", toBob, fromBob.ID, nil},
+		{"message in the same group", toTeam, inTeam.ID, nil},
+		{"message in another direct chat", toBob, toCarol.ID, errParentNotFound},
+		{"message between other users", toBob, betweenOthers.ID, errParentNotFound},
+		{"group message in a direct chat", toBob, inTeam.ID, errParentNotFound},
+		{"direct message in a group", toTeam, fromBob.ID, errParentNotFound},
+		{"message in another group of the sender", toTeam, inOther.ID, errParentNotFound},
+		{"message in a group the sender is not in", toTeam, inPrivate.ID, errParentNotFound},
+		{"unknown message", toBob, inPrivate.ID + 100, errParentNotFound},
+		{"deleted message", toBob, deleted.ID, errParentDeleted},
+	}
+	for _, tt := range tests {
+		_, err := loadReplyParent(tt.parent, tt.reply)
+		if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
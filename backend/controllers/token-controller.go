@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const maxTokenNameLength = 100
+
+// CreatePersonalAccessToken issues a scoped token for scripts. The token is
+// only returned this once.
+func CreatePersonalAccessToken(c *fiber.Ctx) error {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"` // 0 means no expiry
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxTokenNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token name is required and must be at most 100 characters",
+		})
+	}
+
+	scopes, err := parseTokenScopes(req.Scopes)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":       err.Error(),
+			"validScopes": models.TokenScopes,
+		})
+	}
+
+	if req.ExpiresInDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "expiresInDays cannot be negative",
+		})
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		expiresAt = ptrTo(time.Now().AddDate(0, 0, req.ExpiresInDays))
+	}
+
+	token, record, err := utils.IssuePersonalAccessToken(claims.ID, req.Name,
+		scopes, expiresAt)
+	if err != nil {
+		log.Println("Error creating access token:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create access token",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"token":       token,
+		"accessToken": record,
+	})
+}
+
+// GetPersonalAccessTokens lists the user's tokens that are not revoked
+func GetPersonalAccessTokens(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	var tokens []models.PersonalAccessToken
+	if err := database.DB.Where("user_id = ? AND revoked_at IS NULL", claims.ID).
+		Order("id DESC").Find(&tokens).Error; err != nil {
+		log.Println("Error fetching access tokens:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"tokens": tokens,
+	})
+}
+
+// RevokePersonalAccessToken stops a token from working
+func RevokePersonalAccessToken(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	tokenID, err := strconv.Atoi(c.Params("tokenId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid token ID",
+		})
+	}
+
+	result := database.DB.Model(&models.PersonalAccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, claims.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		log.Println("Error revoking access token:", result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke access token",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Access token not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Access token revoked",
+	})
+}
+
+// parseTokenScopes validates requested scopes and removes duplicates
+func parseTokenScopes(requested []string) ([]string, error) {
+	var scopes []string
+	for _, scope := range requested {
+		scope = strings.TrimSpace(scope)
+		if !slices.Contains(models.TokenScopes, scope) {
+			return nil, errors.New("unknown scope: " + scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
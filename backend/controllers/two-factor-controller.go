@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const recoveryCodeCount = 10
+
+// totpIssuer is the account label shown in authenticator apps (TOTP_ISSUER)
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Chat App"
+}
+
+// SetupTwoFactor starts TOTP enrollment: it stores a new secret and returns
+// the otpauth URI to scan. Nothing is enforced until ConfirmTwoFactor.
+func SetupTwoFactor(c *fiber.Ctx) error {
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	if user.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "two-factor authentication is already enabled",
+		})
+	}
+
+	secret := utils.GenerateTOTPSecret()
+	if err := database.DB.Model(&user).Update("totp_secret", secret).Error; err != nil {
+		log.Println("Error storing TOTP secret:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not start two-factor setup",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"secret":     secret,
+		"otpauthUri": utils.TOTPURI(totpIssuer(), user.Email, secret),
+	})
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the user proves
+// their authenticator works, and returns one-time recovery codes. The codes
+// are only shown this once.
+func ConfirmTwoFactor(c *fiber.Ctx) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid input",
+		})
+	}
+
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	if user.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "two-factor authentication is already enabled",
+		})
+	}
+	if user.TOTPSecret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "start two-factor setup first",
+		})
+	}
+
+	step, valid := utils.ValidateTOTP(user.TOTPSecret, strings.TrimSpace(req.Code), time.Now())
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid authentication code",
+		})
+	}
+
+	var recoveryCodes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"two_factor_enabled":  true,
+			"totp_last_used_step": step,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		recoveryCodes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		log.Println("Error enabling two-factor authentication:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not enable two-factor authentication",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":       "two-factor authentication enabled",
+		"recoveryCodes": recoveryCodes,
+	})
+}
+
+// DisableTwoFactor turns two-factor authentication off. It requires the
+// password and a current code (or a recovery code).
+func DisableTwoFactor(c *fiber.Ctx) error {
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid input",
+		})
+	}
+
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	if !user.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "two-factor authentication is not enabled",
+		})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password),
+		[]byte(req.Password)); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "password is incorrect",
+		})
+	}
+
+	valid, err := verifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Println("Error verifying second factor:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not verify authentication code",
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid authentication code",
+		})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"two_factor_enabled":  false,
+			"totp_secret":         "",
+			"totp_last_used_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		log.Println("Error disabling two-factor authentication:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not disable two-factor authentication",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current authentication code
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid input",
+		})
+	}
+
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	if !user.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "two-factor authentication is not enabled",
+		})
+	}
+
+	valid, err := verifySecondFactor(user, req.Code, "")
+	if err != nil {
+		log.Println("Error verifying second factor:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not verify authentication code",
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid authentication code",
+		})
+	}
+
+	var recoveryCodes []string
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		recoveryCodes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		log.Println("Error regenerating recovery codes:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not regenerate recovery codes",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"recoveryCodes": recoveryCodes,
+	})
+}
+
+// LoginTwoFactor is the second login step: it exchanges the challenge token
+// from LoginHandler plus a TOTP or recovery code for a session
+func LoginTwoFactor(c *fiber.Ctx) error {
+	var req struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "unable to parse the input",
+		})
+	}
+
+	userID, err := utils.ValidateChallengeToken(req.ChallengeToken)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "login challenge is invalid or has expired",
+		})
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, userID).Error; err != nil ||
+		!user.TwoFactorEnabled {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "login challenge is invalid or has expired",
+		})
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	email := normalizeEmail(user.Email)
+	wait, err := loginLockout(email, c.IP())
+	if err != nil {
+		log.Println("Error checking login lockout:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not verify authentication code",
+		})
+	}
+	if wait > 0 {
+		recordLoginAttempt(c, email, &user.ID, models.LoginReasonLocked)
+		return loginLockedResponse(c, wait)
+	}
+
+	valid, err := verifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Println("Error verifying second factor:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not verify authentication code",
+		})
+	}
+	if !valid {
+		recordLoginAttempt(c, email, &user.ID, models.LoginReasonInvalid2FACode)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid authentication code",
+		})
+	}
+
+	return completeLogin(c, user)
+}
+
+// verifySecondFactor accepts either a TOTP code, which may not be reused, or
+// an unused recovery code, which is then spent
+func verifySecondFactor(user models.User, code, recoveryCode string) (bool, error) {
+	if code = strings.TrimSpace(code); code != "" {
+		step, valid := utils.ValidateTOTP(user.TOTPSecret, code, time.Now())
+		if !valid {
+			return false, nil
+		}
+
+		// Only a step newer than the last accepted one counts, so an
+		// intercepted code cannot be replayed
+		result := database.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_used_step < ?", user.ID, step).
+			Update("totp_last_used_step", step)
+		return result.RowsAffected == 1, result.Error
+	}
+
+	if recoveryCode = normalizeRecoveryCode(recoveryCode); recoveryCode != "" {
+		result := database.DB.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL",
+				user.ID, utils.HashToken(recoveryCode)).
+			Update("used_at", time.Now())
+		return result.RowsAffected == 1, result.Error
+	}
+
+	return false, nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and stores a new
+// set, returning the codes in the form shown to the user
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).
+		Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := generateRecoveryCode()
+		codes = append(codes, code)
+		records = append(records, models.RecoveryCode{
+			UserID:   userID,
+			CodeHash: utils.HashToken(normalizeRecoveryCode(code)),
+		})
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns an 80-bit code formatted as XXXX-XXXX-XXXX-XXXX
+func generateRecoveryCode() string {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	raw := base32.StdEncoding.EncodeToString(buf)
+	return raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+}
+
+// normalizeRecoveryCode makes codes comparable however they were typed
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
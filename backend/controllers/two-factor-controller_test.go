@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// currentTOTP computes the code an authenticator app shows right now
+func currentTOTP(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1_000_000)
+}
+
+func setupTwoFactorLogin(t *testing.T) (models.User, *fiber.App) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	if _, err := utils.InitializeTokenService(); err != nil {
+		t.Fatal(err)
+	}
+	databasetest.Open(t, &models.User{}, &models.Session{}, &models.LoginAttempt{},
+		&models.RecoveryCode{})
+
+	user := createUser(t, "user@example.com", true)
+	user.TwoFactorEnabled = true
+	user.TOTPSecret = utils.GenerateTOTPSecret()
+	database.DB.Save(&user)
+
+	app := fiber.New()
+	app.Post("/api/auth/login/2fa", LoginTwoFactor)
+	return user, app
+}
+
+// loginTwoFactor completes a login with a fresh challenge, as after a
+// correct password
+func loginTwoFactor(t *testing.T, app *fiber.App, user models.User, field, code string) int {
+	t.Helper()
+	challenge, err := utils.CreateChallengeToken(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postJSON(t, app, "/api/auth/login/2fa",
+		fmt.Sprintf(`{"challengeToken": %q, %q: %q}`, challenge, field, code))
+}
+
+func TestLoginTwoFactorRefusesReplayedCode(t *testing.T) {
+	user, app := setupTwoFactorLogin(t)
+	code := currentTOTP(t, user.TOTPSecret)
+
+	if status := loginTwoFactor(t, app, user, "code", code); status != http.StatusOK {
+		t.Fatalf("first use: status %d", status)
+	}
+	if status := loginTwoFactor(t, app, user, "code", code); status != http.StatusBadRequest {
+		t.Fatalf("replayed code: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	var failures int64
+	database.DB.Model(&models.LoginAttempt{}).
+		Where("reason = ?", models.LoginReasonInvalid2FACode).Count(&failures)
+	if failures != 1 {
+		t.Fatalf("%d failed attempts recorded, want the replay counted", failures)
+	}
+}
+
+func TestLoginTwoFactorRecoveryCodeSingleUse(t *testing.T) {
+	user, app := setupTwoFactorLogin(t)
+	codes, err := replaceRecoveryCodes(database.DB, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// However it is typed
+	if status := loginTwoFactor(t, app, user, "recoveryCode",
+		strings.ToLower(strings.ReplaceAll(codes[0], "-", " "))); status != http.StatusOK {
+		t.Fatalf("recovery code: status %d", status)
+	}
+	if status := loginTwoFactor(t, app, user, "recoveryCode", codes[0]); status != http.StatusBadRequest {
+		t.Fatalf("spent recovery code: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := loginTwoFactor(t, app, user, "recoveryCode", codes[1]); status != http.StatusOK {
+		t.Fatalf("another recovery code: status %d", status)
+	}
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// emailVerificationTTL is how long a verification link stays valid
+// (EMAIL_VERIFICATION_TTL, default 24h)
+func emailVerificationTTL() time.Duration {
+	return utils.GetEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+}
+
+// emailVerificationCooldown is the minimum time between two verification
+// emails (EMAIL_VERIFICATION_RESEND_COOLDOWN, default 1m)
+func emailVerificationCooldown() time.Duration {
+	return utils.GetEnvDuration("EMAIL_VERIFICATION_RESEND_COOLDOWN", time.Minute)
+}
+
+// clientLink builds a link to a page of the frontend
+func clientLink(path string, query url.Values) string {
+	return os.Getenv("CLIENT_URL") + path + "?" + query.Encode()
+}
+
+// sendVerificationEmail issues a fresh verification token and mails it
+func sendVerificationEmail(user models.User) error {
+	token, err := utils.IssueUserToken(user.ID,
+		models.TokenPurposeEmailVerification, emailVerificationTTL())
+	if err != nil {
+		return err
+	}
+
+	link := clientLink("/verify-email", url.Values{"token": {token}})
+	return utils.AppMailer.Send(context.Background(), utils.Email{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you did not sign up, you can ignore this email.\n",
+			user.FullName, link, emailVerificationTTL()),
+	})
+}
+
+// VerifyEmail confirms an email address with the token from the emailed link
+func VerifyEmail(c *fiber.Ctx) error {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "verification token is required",
+		})
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		userToken, err := utils.ConsumeUserToken(tx, req.Token,
+			models.TokenPurposeEmailVerification)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", userToken.UserID).
+			Update("email_verified_at", time.Now()).Error
+	})
+	if err != nil {
+		if errors.Is(err, utils.ErrUserTokenInvalid) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "verification link is invalid or has expired",
+			})
+		}
+		log.Println("Error verifying email:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not verify email",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "email verified",
+	})
+}
+
+// ResendVerificationEmail mails a new verification link to the logged-in
+// user, at most once per cooldown period
+func ResendVerificationEmail(c *fiber.Ctx) error {
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "email is already verified",
+		})
+	}
+
+	latest, err := utils.LatestUserToken(user.ID, models.TokenPurposeEmailVerification)
+	if err == nil {
+		if wait := emailVerificationCooldown() - time.Since(latest.CreatedAt); wait > 0 {
+			c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(wait.Seconds())+1))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":      "please wait before requesting another email",
+				"retryAfter": int(wait.Seconds()) + 1,
+			})
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Println("Error fetching verification token:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not send verification email",
+		})
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		log.Println("Error sending verification email:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "could not send verification email",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "verification email sent",
+	})
+}
@@ -0,0 +1,44 @@
+// Package databasetest points database.DB at a throwaway SQLite database
+// for tests, so code using the global connection can be exercised
+// without a Postgres server.
+package databasetest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chat-app/database"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open creates a fresh database with tables for the given models and makes
+// it database.DB until the test ends
+func Open(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	// A file rather than memory, so the pool's connections share it and
+	// writers from other goroutines wait for each other
+	dsn := filepath.Join(t.TempDir(), "test.db") +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
@@ -1,17 +1,74 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 
+	"github.com/chat-app/controllers"
 	"github.com/chat-app/database"
 	"github.com/chat-app/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/websocket/v2"
 	"github.com/joho/godotenv"
+	"github.com/valyala/fasthttp"
 )
 
+// The routes that send messages, which may carry attachments
+var sendMessagePath = regexp.MustCompile(`(?i)^/api/(messages/send/[^/]+|conversations/[^/]+/messages)/?$`)
+
+// messageBodyLimit raises the body limit to limit for requests sending a
+// message with credentials. It runs once the headers are read, before the
+// body is, so no other request can make the server buffer that much.
+func messageBodyLimit(limit int) func(*fasthttp.RequestHeader) fasthttp.RequestConfig {
+	return func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+		path, _, _ := bytes.Cut(header.RequestURI(), []byte("?"))
+		if !header.IsPost() || !sendMessagePath.Match(path) {
+			return fasthttp.RequestConfig{}
+		}
+		if len(header.Peek(fiber.HeaderAuthorization)) == 0 &&
+			len(header.Cookie(utils.CookieName)) == 0 {
+			return fasthttp.RequestConfig{}
+		}
+		return fasthttp.RequestConfig{MaxRequestBodySize: limit}
+	}
+}
+
+// proxyConfig makes c.IP(), which login throttling and session records rely
+// on, report the client's address behind a reverse proxy. TRUSTED_PROXIES
+// lists the proxies' addresses or CIDR ranges, comma separated, and
+// PROXY_HEADER the header they put the client address in (default
+// X-Real-IP; the proxy must overwrite it, e.g. nginx's
+// "proxy_set_header X-Real-IP $remote_addr"). The header is only believed
+// on connections from a trusted proxy. Without TRUSTED_PROXIES it is ignored
+// and the connection's address is used.
+func proxyConfig() fiber.Config {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if len(proxies) == 0 {
+		return fiber.Config{}
+	}
+
+	header := os.Getenv("PROXY_HEADER")
+	if header == "" {
+		header = "X-Real-IP"
+	}
+	return fiber.Config{
+		ProxyHeader:             header,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          proxies,
+		EnableIPValidation:      true,
+	}
+}
+
 func main() {
 	// Load .env file
 	err := godotenv.Load()
@@ -25,8 +82,33 @@ func main() {
 	// Run Migrations
 	RunMigrations()
 
-	// Create a Fiber app
-	app := fiber.New()
+	// Initialize the token service that signs and verifies JWTs
+	if _, err := utils.InitializeTokenService(); err != nil {
+		log.Fatalf("Failed to initialize token service: %v", err)
+	}
+
+	// Initialize media storage
+	if _, err := utils.InitializeStorage(); err != nil {
+		log.Fatalf("Failed to initialize media storage: %v", err)
+	}
+
+	// Initialize the mailer
+	if _, err := utils.InitializeMailer(); err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	// Initialize single sign-on (only when OIDC_ISSUER is set)
+	if _, err := utils.InitializeOIDC(); err != nil {
+		log.Fatalf("Failed to initialize single sign-on: %v", err)
+	}
+
+	// Deliver messages to bot webhooks in the background
+	utils.StartWebhookWorker(context.Background())
+
+	// Create a Fiber app. Bodies keep Fiber's default limit except on the
+	// routes sending messages, which accept the largest attachments.
+	app := fiber.New(proxyConfig())
+	app.Server().HeaderReceived = messageBodyLimit(utils.LoadAttachmentLimits().RequestBodyLimit())
 
 	app.Use(cors.New(cors.Config{
 		// AllowOrigins:     "http://localhost:5173",  // for development
@@ -39,7 +121,11 @@ func main() {
 	// Routes
 	RoutesSetup(app, database.DB)
 
-	// WebSocket route
+	// WebSocket route and the client events it understands
+	utils.RegisterSocketEvent("markRead", controllers.MarkReadSocketEvent)
+	utils.RegisterSocketEvent("typing", utils.TypingSocketEvent)
+	utils.RegisterSocketEvent("stopTyping", utils.StopTypingSocketEvent)
+	utils.OnSocketConnect(controllers.MarkMessagesDelivered)
 	app.Get("/api/ws", websocket.New(utils.WebSocketHandler))
 
 	// Start server
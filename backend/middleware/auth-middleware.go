@@ -1,64 +1,55 @@
 package middleware
 
 import (
-	"os"
+	"errors"
+	"strings"
 
 	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 	"gorm.io/gorm" // For database interaction
 )
 
-const CookieName = "auth_token"
-
-// Secret key used for signing JWT
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-
-// AuthMiddleware ensures the user is authenticated
+// AuthMiddleware ensures the user is authenticated, either by a session's
+// access token (cookie or bearer) or by a personal access token (bearer).
+//
+// Personal access tokens only reach routes that opt in with RequireScope;
+// until then the user is kept in "tokenUser" instead of "user".
 func AuthMiddleware(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// Retrieve the token from the cookie
-		tokenStr := c.Cookies(CookieName)
+		// Retrieve the token from the Authorization header or the cookie
+		tokenStr := requestToken(c)
 		if tokenStr == "" {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Authentication required",
 			})
 		}
 
-		// Parse and validate the JWT token (got from cookie)
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			// Validate the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
-			}
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid or expired token",
-			})
+		if utils.IsPersonalAccessToken(tokenStr) {
+			return personalAccessTokenAuth(c, db, tokenStr)
 		}
 
-		// Retrieve custom claims from the token
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token claims",
-			})
-		}
-
-		// Get the user ID from claims
-		userID, ok := claims["id"].(float64) // Use float64 because JWT encodes numbers as float64
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "User ID not found in token",
+		// Validate the JWT token (got from cookie) and its session
+		userID, session, err := utils.AuthenticateAccessToken(tokenStr)
+		if err != nil {
+			if errors.Is(err, utils.ErrSessionInvalid) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Session has been revoked or expired",
+				})
+			}
+			if errors.Is(err, utils.ErrInvalidToken) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Invalid or expired token",
+				})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to validate session",
 			})
 		}
 
 		// Fetch user details from the database
 		var user models.User
-		if err := db.First(&user, uint(userID)).Error; err != nil {
+		if err := db.First(&user, userID).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 					"error": "User not found",
@@ -71,8 +62,50 @@ func AuthMiddleware(db *gorm.DB) fiber.Handler {
 
 		// Attach the user object to the context for use in downstream handlers
 		c.Locals("user", user)
+		c.Locals("session", session)
 
 		// Proceed to the next handler
 		return c.Next()
 	}
 }
+
+// personalAccessTokenAuth authenticates a request made with a personal
+// access token
+func personalAccessTokenAuth(c *fiber.Ctx, db *gorm.DB, tokenStr string) error {
+	token, err := utils.AuthenticatePersonalAccessToken(tokenStr)
+	if err != nil {
+		if errors.Is(err, utils.ErrPersonalAccessTokenInvalid) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid or expired token",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to validate token",
+		})
+	}
+
+	var user models.User
+	if err := db.First(&user, token.UserID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve user information",
+		})
+	}
+
+	c.Locals("token", token)
+	c.Locals("tokenUser", user)
+	return c.Next()
+}
+
+// requestToken returns the bearer token if there is one, else the cookie
+func requestToken(c *fiber.Ctx) string {
+	scheme, token, found := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return c.Cookies(utils.CookieName)
+}
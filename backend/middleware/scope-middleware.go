@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireScope lets personal access tokens with the scope use a route.
+// Browser sessions are not limited by scopes and pass straight through. It
+// must run after AuthMiddleware and before middleware that needs the user.
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token, ok := c.Locals("token").(models.PersonalAccessToken)
+		if !ok {
+			return c.Next()
+		}
+
+		if !token.HasScope(scope) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Token is missing the " + scope + " scope",
+			})
+		}
+
+		c.Locals("user", c.Locals("tokenUser"))
+		return c.Next()
+	}
+}
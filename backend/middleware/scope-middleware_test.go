@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// whoAmI answers with the user's name, or 401 like every handler does
+// without a user
+func whoAmI(c *fiber.Ctx) error {
+	user, ok := c.Locals("user").(models.User)
+	if !ok {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	return c.SendString(user.FullName)
+}
+
+func setupScopes(t *testing.T) (models.User, *fiber.App) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	if _, err := utils.InitializeTokenService(); err != nil {
+		t.Fatal(err)
+	}
+	databasetest.Open(t, &models.User{}, &models.Session{}, &models.PersonalAccessToken{})
+
+	user := models.User{Email: "user@example.com", FullName: "User", Password: "x"}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	// Stands in for logging in, which hands out a session's access token
+	app.Post("/login", func(c *fiber.Ctx) error {
+		token, err := utils.StartSession(c, user)
+		if err != nil {
+			return err
+		}
+		return c.SendString(token)
+	})
+	api := app.Group("/api", AuthMiddleware(database.DB))
+	api.Get("/read", RequireScope(models.ScopeMessagesRead), whoAmI)
+	api.Post("/write", RequireScope(models.ScopeMessagesWrite), whoAmI)
+	api.Get("/account", whoAmI)
+	return user, app
+}
+
+func request(t *testing.T, app *fiber.App, method, path, token string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestRequireScope(t *testing.T) {
+	user, app := setupScopes(t)
+	readOnly, _, err := utils.IssuePersonalAccessToken(user.ID, "reader",
+		[]string{models.ScopeMessagesRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, session := request(t, app, http.MethodPost, "/login", "")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"token with the scope", http.MethodGet, "/api/read", readOnly, http.StatusOK},
+		{"token without the scope", http.MethodPost, "/api/write", readOnly, http.StatusForbidden},
+		// Routes that did not opt in never see the token's user
+		{"route without a scope", http.MethodGet, "/api/account", readOnly, http.StatusUnauthorized},
+		{"session on a scoped route", http.MethodPost, "/api/write", session, http.StatusOK},
+		{"session on an unscoped route", http.MethodGet, "/api/account", session, http.StatusOK},
+		{"no credentials", http.MethodGet, "/api/read", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/api/read", "chat_pat_" + utils.GenerateToken(32),
+			http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		if status, _ := request(t, app, tt.method, tt.path, tt.token); status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.want)
+		}
+	}
+}
+
+func TestRequireScopeRefusesInactiveTokens(t *testing.T) {
+	user, app := setupScopes(t)
+	scopes := []string{models.ScopeMessagesRead}
+
+	revokedToken, _, _ := utils.IssuePersonalAccessToken(user.ID, "revoked", scopes, nil)
+	if err := utils.RevokePersonalAccessTokens(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Minute)
+	expiredToken, _, _ := utils.IssuePersonalAccessToken(user.ID, "expired", scopes, &expired)
+
+	for name, token := range map[string]string{"expired": expiredToken, "revoked": revokedToken} {
+		if status, _ := request(t, app, http.MethodGet, "/api/read", token); status != http.StatusUnauthorized {
+			t.Errorf("%s token: status %d, want %d", name, status, http.StatusUnauthorized)
+		}
+	}
+}
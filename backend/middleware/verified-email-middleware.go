@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireVerifiedEmail blocks users who have not verified their email yet,
+// when REQUIRE_EMAIL_VERIFICATION is enabled. It must run after AuthMiddleware.
+func RequireVerifiedEmail() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !utils.GetEnvBool("REQUIRE_EMAIL_VERIFICATION", false) {
+			return c.Next()
+		}
+
+		user, ok := c.Locals("user").(models.User)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Authentication required",
+			})
+		}
+
+		if user.EmailVerifiedAt == nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Please verify your email address first",
+			})
+		}
+
+		return c.Next()
+	}
+}
@@ -13,11 +13,51 @@ func RunMigrations() {
 
 	err := database.DB.AutoMigrate(
 		&models.User{},
+		&models.Session{},
+		&models.UserToken{},
+		&models.RecoveryCode{},
+		&models.LoginAttempt{},
+		&models.UserIdentity{},
+		&models.PersonalAccessToken{},
+		&models.BotWebhook{},
+		&models.WebhookDelivery{},
+		&models.IncomingWebhook{},
+		&models.Conversation{},
+		&models.ConversationMember{},
 		&models.Message{},
+		&models.MessageEdit{},
+		&models.MessageDeletion{},
+		&models.MessageReaction{},
+		&models.Attachment{},
+		&models.LinkPreview{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
+	// Indexes GORM tags cannot express
+	statements := []string{
+		// Logins, signups and single sign-on look emails up regardless of
+		// case. This serves those lookups, and keeps two accounts from
+		// differing only by case.
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower
+			ON users (LOWER(email))`,
+		// Partial index for unread counts of direct messages
+		`CREATE INDEX IF NOT EXISTS idx_messages_unread
+			ON messages (receiver_id, sender_id)
+			WHERE read_at IS NULL AND conversation_id IS NULL`,
+		// Full-text search over message text. The "simple" configuration
+		// does no stemming, so it behaves the same for every language.
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS text_search tsvector
+			GENERATED ALWAYS AS (to_tsvector('simple', coalesce(text, ''))) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_text_search
+			ON messages USING GIN (text_search)`,
+	}
+	for _, statement := range statements {
+		if err := database.DB.Exec(statement).Error; err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+	}
+
 	log.Println("Database migrations completed successfully!")
 }
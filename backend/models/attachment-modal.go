@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+)
+
+// Attachment kinds: any file, or a voice message recorded in the chat
+const (
+	AttachmentKindFile  = "file"
+	AttachmentKindAudio = "audio"
+)
+
+// Attachment is a file sent with a message. The stored object is never
+// linked to directly; clients download it through the API, which checks
+// that they take part in the chat.
+type Attachment struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	MessageID   uint   `gorm:"not null;index" json:"messageId"`
+	Name        string `gorm:"not null;size:255" json:"name"`
+	Size        int64  `gorm:"not null" json:"size"`
+	ContentType string `gorm:"not null;size:255" json:"contentType"`
+	Kind        string `gorm:"not null;size:16;default:'file'" json:"kind"`
+	// Checksum is the hex encoded SHA-256 of the content
+	Checksum   string `gorm:"not null;size:64" json:"checksum"`
+	StorageKey string `gorm:"not null" json:"-"`
+	// Length and loudness (up to 64 values from 0 to 255) of voice messages
+	DurationMs int       `gorm:"not null;default:0" json:"durationMs,omitempty"`
+	Waveform   []int     `gorm:"type:text;serializer:json" json:"waveform,omitempty"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	// URL is the download endpoint, filled in when attachments are listed
+	URL string `gorm:"-" json:"url"`
+}
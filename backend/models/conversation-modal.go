@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+)
+
+// Roles a member can hold inside a group conversation
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+type Conversation struct {
+	ID          uint                 `gorm:"primaryKey" json:"id"`
+	Name        string               `gorm:"not null" json:"name"`
+	CreatedByID uint                 `gorm:"not null" json:"createdById"`
+	Members     []ConversationMember `gorm:"constraint:OnDelete:CASCADE" json:"members,omitempty"`
+	CreatedAt   time.Time            `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt   time.Time            `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+type ConversationMember struct {
+	ID             uint   `gorm:"primaryKey" json:"id"`
+	ConversationID uint   `gorm:"not null;uniqueIndex:idx_conversation_member" json:"conversationId"`
+	UserID         uint   `gorm:"not null;uniqueIndex:idx_conversation_member;index" json:"userId"`
+	Role           string `gorm:"not null;default:'member'" json:"role"`
+	// LastReadMessageID is the newest group message this member has read
+	LastReadMessageID *uint     `json:"lastReadMessageId"`
+	User              *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	CreatedAt         time.Time `gorm:"autoCreateTime" json:"joinedAt"`
+	UpdatedAt         time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+// RoleRank orders roles so that permission checks can compare them
+func RoleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 3
+	case RoleAdmin:
+		return 2
+	case RoleMember:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// IncomingWebhook lets an external system post messages without a session.
+// It posts as BotID into either a group conversation or a direct chat with
+// TargetUserID. Key identifies the webhook in its URL; requests prove they
+// know Secret by sending it as a bearer token or by signing the body.
+type IncomingWebhook struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	OwnerID        uint       `gorm:"not null;index" json:"ownerId"`
+	BotID          uint       `gorm:"not null" json:"botId"`
+	Name           string     `gorm:"not null" json:"name"`
+	ConversationID *uint      `gorm:"index" json:"conversationId"`
+	TargetUserID   *uint      `json:"targetUserId"`
+	Key            string     `gorm:"not null;uniqueIndex;size:64" json:"key"`
+	Secret         string     `gorm:"not null" json:"-"`
+	LastUsedAt     *time.Time `json:"lastUsedAt"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime" json:"updatedAt"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// LinkPreview caches the page metadata shown under messages linking to a
+// URL. Failed fetches are cached too, so a broken link is not fetched again
+// for every message that repeats it.
+type LinkPreview struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	URL         string    `gorm:"not null;size:2048;uniqueIndex" json:"url"`
+	Title       string    `gorm:"not null;default:''" json:"title"`
+	Description string    `gorm:"not null;default:''" json:"description"`
+	ImageURL    string    `gorm:"not null;default:''" json:"imageUrl"`
+	SiteName    string    `gorm:"not null;default:''" json:"siteName"`
+	Failed      bool      `gorm:"not null;default:false" json:"-"`
+	FetchedAt   time.Time `gorm:"not null" json:"fetchedAt"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"-"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"-"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// Outcomes recorded for a login attempt
+const (
+	LoginReasonSuccess        = "success"
+	LoginReasonUnknownEmail   = "unknown_email"
+	LoginReasonWrongPassword  = "wrong_password"
+	LoginReasonInvalid2FACode = "invalid_2fa_code"
+	LoginReasonLocked         = "locked"
+)
+
+// LoginAttempt is the audit record of a login attempt. Failure counters for
+// throttling are computed from these rows, per email and per IP address.
+type LoginAttempt struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Email     string    `gorm:"not null;index:idx_login_attempts_email,priority:1" json:"email"`
+	UserID    *uint     `gorm:"index" json:"userId"`
+	IPAddress string    `gorm:"not null;index:idx_login_attempts_ip,priority:1" json:"ipAddress"`
+	UserAgent string    `json:"userAgent"`
+	Success   bool      `gorm:"not null" json:"success"`
+	Reason    string    `gorm:"not null" json:"reason"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index:idx_login_attempts_email,priority:2;index:idx_login_attempts_ip,priority:2" json:"createdAt"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"time"
+)
+
+// MessageDeletion hides a message from a single user ("delete for me")
+type MessageDeletion struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_deletion" json:"messageId"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_deletion" json:"userId"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"time"
+)
+
+// MessageEdit keeps the text a message had before one of its edits
+type MessageEdit struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"not null;index" json:"messageId"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"editedAt"`
+}
@@ -4,12 +4,55 @@ import (
 	"time"
 )
 
+// The composite indexes serve cursor pagination: direct chats are looked up
+// by (sender, receiver) in both directions and groups by conversation, each
+// walked in message ID order.
 type Message struct {
-	ID         uint      `gorm:"primaryKey" json:"id"`
-	SenderID   uint      `gorm:"not null" json:"senderId"`
-	ReceiverID uint      `gorm:"not null" json:"receiverId"`
-	Text       string    `json:"text"`
-	Image      string    `json:"image"`
-	CreatedAt  time.Time `gorm:"autoCreateTime" json:"createdAt"`
-	UpdatedAt  time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	ID         uint `gorm:"primaryKey;index:idx_messages_direct,priority:3;index:idx_messages_conversation,priority:2" json:"id"`
+	SenderID   uint `gorm:"not null;index:idx_messages_direct,priority:1" json:"senderId"`
+	ReceiverID uint `gorm:"not null;index:idx_messages_direct,priority:2" json:"receiverId"` // 0 for group messages
+	// ConversationID is set for group messages and nil for direct messages
+	ConversationID *uint  `gorm:"index:idx_messages_conversation,priority:1" json:"conversationId,omitempty"`
+	Text           string `json:"text"`
+	Image          string `json:"image"`
+	// Smaller renditions of the image for the chat view
+	ImagePreview   string `json:"imagePreview"`
+	ImageThumbnail string `json:"imageThumbnail"`
+	// ImageKeys are the storage keys of the renditions uploaded with the
+	// message. Deleting the message removes these, never files found from
+	// its URLs, which could point at someone else's upload.
+	ImageKeys []string `gorm:"type:text;serializer:json" json:"-"`
+	// ParentID is the message this one replies to, in the same chat;
+	// ReplyCount counts the direct replies to this message
+	ParentID   *uint `gorm:"index" json:"parentId,omitempty"`
+	ReplyCount int   `gorm:"not null;default:0" json:"replyCount"`
+	// LinkPreviewID is set once the first link in the text has been fetched
+	LinkPreviewID *uint `json:"-"`
+	// Receipts for direct messages; group read state lives on the membership
+	DeliveredAt *time.Time `json:"deliveredAt"`
+	ReadAt      *time.Time `json:"readAt"`
+	EditedAt    *time.Time `json:"editedAt"`
+	// DeletedAt marks a message deleted for everyone; its content is wiped
+	// but the row stays so the chat can show a placeholder
+	DeletedAt *time.Time `json:"deletedAt"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt time.Time  `gorm:"autoUpdateTime" json:"updatedAt"`
+	// Reactions are aggregated per emoji when messages are listed
+	Reactions []ReactionCount `gorm:"-" json:"reactions,omitempty"`
+	// Attachments are the files sent with the message
+	Attachments []Attachment `gorm:"-" json:"attachments,omitempty"`
+	// LinkPreview describes the first link in the text
+	LinkPreview *LinkPreview `gorm:"-" json:"linkPreview,omitempty"`
+	// Parent quotes the message replied to
+	Parent *MessageQuote `gorm:"-" json:"parent,omitempty"`
+}
+
+// MessageQuote is the short form of a replied-to message shown above the reply
+type MessageQuote struct {
+	ID         uint   `json:"id"`
+	SenderID   uint   `json:"senderId"`
+	Text       string `json:"text"`
+	HasImage   bool   `json:"hasImage"`
+	Deleted    bool   `json:"deleted"`
+	ReplyCount int    `json:"replyCount"`
 }
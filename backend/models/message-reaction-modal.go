@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// MessageReaction is one user's emoji reaction to a message. A user can
+// react with several emojis, but with each one only once.
+type MessageReaction struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_reaction,priority:1" json:"messageId"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_reaction,priority:2" json:"userId"`
+	Emoji     string    `gorm:"not null;size:64;uniqueIndex:idx_message_reaction,priority:3" json:"emoji"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// ReactionCount is the aggregate of one emoji on a message. Reacted tells
+// whether the user the messages were loaded for is among them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes a personal access token can be granted. Browser sessions are not
+// limited by scopes.
+const (
+	ScopeMessagesRead       = "messages:read"
+	ScopeMessagesWrite      = "messages:write"
+	ScopeConversationsWrite = "conversations:write"
+)
+
+// TokenScopes lists every valid scope
+var TokenScopes = []string{ScopeMessagesRead, ScopeMessagesWrite, ScopeConversationsWrite}
+
+// PersonalAccessToken is a long-lived credential for scripts, sent as
+// "Authorization: Bearer <token>". Only its hash is stored; Prefix keeps the
+// first characters so users can tell their tokens apart.
+type PersonalAccessToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"userId"`
+	Name       string     `gorm:"not null" json:"name"`
+	TokenHash  string     `gorm:"not null;uniqueIndex;size:64" json:"-"`
+	Prefix     string     `gorm:"not null" json:"prefix"`
+	Scopes     string     `gorm:"not null" json:"scopes"` // space separated
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"-"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// Active reports whether the token can still be used
+func (t PersonalAccessToken) Active() bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || time.Now().Before(*t.ExpiresAt))
+}
+
+// HasScope reports whether the token was granted the scope
+func (t PersonalAccessToken) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(t.Scopes), scope)
+}
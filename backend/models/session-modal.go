@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a signed-in device. Access tokens carry its ID and stop
+// working once it is revoked; the refresh token is stored hashed and
+// replaced on every refresh.
+type Session struct {
+	ID               uint   `gorm:"primaryKey" json:"id"`
+	UserID           uint   `gorm:"not null;index" json:"userId"`
+	RefreshTokenHash string `gorm:"not null;uniqueIndex;size:64" json:"-"`
+	// PreviousTokenHash is the refresh token the current one replaced;
+	// seeing it again means the token was stolen and replayed
+	PreviousTokenHash string     `gorm:"index;size:64" json:"-"`
+	RotatedAt         *time.Time `json:"-"`
+	UserAgent         string     `json:"userAgent"`
+	IPAddress         string     `json:"ipAddress"`
+	LastUsedAt        time.Time  `json:"lastUsedAt"`
+	ExpiresAt         time.Time  `gorm:"not null" json:"expiresAt"`
+	RevokedAt         *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt         time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt         time.Time  `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+// Active reports whether the session can still be used
+func (s Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// UserIdentity links a user to an account at an external identity provider
+// used for single sign-on. Subject is the provider's stable user ID.
+type UserIdentity struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"userId"`
+	Provider  string    `gorm:"not null;uniqueIndex:idx_user_identity" json:"provider"`
+	Subject   string    `gorm:"not null;uniqueIndex:idx_user_identity" json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+}
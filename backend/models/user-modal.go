@@ -4,12 +4,31 @@ import (
 	"time"
 )
 
+// User types. Bots are owned by a regular user, cannot log in and act only
+// through access tokens.
+const (
+	UserTypeHuman = "user"
+	UserTypeBot   = "bot"
+)
+
 type User struct {
-	ID         uint      `gorm:"primaryKey" json:"id"`
-	Email      string    `gorm:"unique;not null" json:"email"`
-	FullName   string    `gorm:"not null" json:"fullname"`
-	Password   string    `gorm:"not null;size:255" json:"password"`
-	ProfilePic string    `gorm:"default:''" json:"profilePic"`
-	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt  time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	Email      string `gorm:"unique;not null" json:"email"`
+	FullName   string `gorm:"not null" json:"fullname"`
+	Password   string `gorm:"not null;size:255" json:"password"`
+	ProfilePic string `gorm:"default:''" json:"profilePic"`
+	// Smaller renditions of the profile picture, stored next to it
+	ProfilePicPreview   string `gorm:"default:''" json:"profilePicPreview"`
+	ProfilePicThumbnail string `gorm:"default:''" json:"profilePicThumbnail"`
+	Type                string `gorm:"not null;default:'user'" json:"type"`
+	BotOwnerID          *uint  `gorm:"index" json:"botOwnerId,omitempty"`
+	// EmailVerifiedAt stays nil until the emailed verification link is used
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	// TOTP two-factor authentication; the secret is set during enrollment
+	// and only enforced once TwoFactorEnabled is true
+	TwoFactorEnabled bool      `gorm:"not null;default:false" json:"twoFactorEnabled"`
+	TOTPSecret       string    `json:"-"`
+	TOTPLastUsedStep int64     `json:"-"`
+	CreatedAt        time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt        time.Time `gorm:"autoUpdateTime" json:"updated_at"`
 }
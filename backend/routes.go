@@ -3,27 +3,95 @@ package main
 import (
 	"github.com/chat-app/controllers"
 	"github.com/chat-app/middleware"
+	"github.com/chat-app/models"
+	"github.com/chat-app/utils"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
 
 func RoutesSetup(app *fiber.App, db *gorm.DB) {
+	// Public keys for verifying the tokens this server issues
+	app.Get("/.well-known/jwks.json", controllers.GetJWKS)
+
 	// Auth Routes
 	app.Post("/api/auth/signup", controllers.SignupHandler)
 	app.Post("/api/auth/logout", controllers.LogoutHandler)
 	app.Post("/api/auth/login", controllers.LoginHandler)
+	app.Post("/api/auth/login/2fa", controllers.LoginTwoFactor)
+	app.Post("/api/auth/refresh", controllers.RefreshHandler)
+	app.Post("/api/auth/verify-email", controllers.VerifyEmail)
+	app.Post("/api/auth/forgot-password", controllers.ForgotPassword)
+	app.Post("/api/auth/reset-password", controllers.ResetPassword)
+	app.Get("/api/auth/oidc/login", controllers.OIDCLogin)
+	app.Get("/api/auth/oidc/callback", controllers.OIDCCallback)
+
+	// Incoming webhooks authenticate with their own secret
+	app.Post("/api/hooks/:key", controllers.PostIncomingWebhook)
+
+	// Media served by the local storage driver (access is via signed URLs)
+	if localStorage, ok := utils.MediaStorage.(*utils.LocalStorage); ok {
+		app.Get(localStorage.Route(), localStorage.Serve)
+	}
 
 	// AuthMiddleware ensures the user is authenticated (to proceed)
 	app.Use(middleware.AuthMiddleware(db))
 	// Now User will be available to be used in authenticated routes
 	// and info can be passed through him
 	app.Get("/api/auth/check", controllers.SignedInUser)
+	app.Post("/api/auth/verify-email/resend", controllers.ResendVerificationEmail)
+	app.Put("/api/auth/change-password", controllers.ChangePassword)
+	app.Post("/api/auth/2fa/setup", controllers.SetupTwoFactor)
+	app.Post("/api/auth/2fa/confirm", controllers.ConfirmTwoFactor)
+	app.Post("/api/auth/2fa/disable", controllers.DisableTwoFactor)
+	app.Post("/api/auth/2fa/recovery-codes", controllers.RegenerateRecoveryCodes)
+	app.Get("/api/auth/identities", controllers.GetIdentities)
+	app.Get("/api/auth/sessions", controllers.GetSessions)
+	app.Delete("/api/auth/sessions", controllers.RevokeOtherSessions)
+	app.Delete("/api/auth/sessions/:sessionId", controllers.RevokeSession)
+
+	// Personal access tokens; managing them needs a browser session
+	app.Get("/api/tokens", controllers.GetPersonalAccessTokens)
+	app.Post("/api/tokens", controllers.CreatePersonalAccessToken)
+	app.Delete("/api/tokens/:tokenId", controllers.RevokePersonalAccessToken)
+
+	// Bots and their outgoing webhooks; bots act with their own tokens
+	app.Get("/api/bots", controllers.GetBots)
+	app.Post("/api/bots", controllers.CreateBot)
+	app.Post("/api/bots/:botId/token", controllers.RotateBotToken)
+	app.Get("/api/bots/:botId/webhooks", controllers.GetBotWebhooks)
+	app.Post("/api/bots/:botId/webhooks", controllers.CreateBotWebhook)
+	app.Delete("/api/bots/:botId/webhooks/:webhookId", controllers.DeleteBotWebhook)
+	app.Get("/api/bots/:botId/webhooks/:webhookId/deliveries", controllers.GetWebhookDeliveries)
+
+	app.Get("/api/webhooks/incoming", controllers.GetIncomingWebhooks)
+	app.Post("/api/webhooks/incoming", controllers.CreateIncomingWebhook)
+	app.Delete("/api/webhooks/incoming/:webhookId", controllers.DeleteIncomingWebhook)
 
 	// User Routes
 	app.Put("/api/user/update-profile", controllers.UpdateProfile)
 
-	// Message Routes
-	app.Get("/api/messages/users", controllers.GetUsersForSidebar)
-	app.Get("/api/messages/:id", controllers.GetMessages)
-	app.Post("/api/messages/send/:id", controllers.SendMessage)
+	// Message Routes (personal access tokens need the scope in RequireScope)
+	app.Get("/api/messages/users", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetUsersForSidebar)
+	app.Get("/api/messages/search", middleware.RequireScope(models.ScopeMessagesRead), controllers.SearchMessages)
+	app.Get("/api/messages/:id", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetMessages)
+	app.Post("/api/messages/send/:id", middleware.RequireScope(models.ScopeMessagesWrite), middleware.RequireVerifiedEmail(), controllers.SendMessage)
+	app.Post("/api/messages/read/:id", middleware.RequireScope(models.ScopeMessagesWrite), controllers.MarkMessagesRead)
+	app.Put("/api/messages/edit/:messageId", middleware.RequireScope(models.ScopeMessagesWrite), controllers.EditMessage)
+	app.Get("/api/messages/edit/:messageId", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetMessageEdits)
+	app.Delete("/api/messages/delete/:messageId", middleware.RequireScope(models.ScopeMessagesWrite), controllers.DeleteMessage)
+	app.Post("/api/messages/react/:messageId", middleware.RequireScope(models.ScopeMessagesWrite), controllers.AddReaction)
+	app.Delete("/api/messages/react/:messageId", middleware.RequireScope(models.ScopeMessagesWrite), controllers.RemoveReaction)
+	app.Get("/api/messages/thread/:messageId", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetThread)
+	app.Get("/api/attachments/:attachmentId", middleware.RequireScope(models.ScopeMessagesRead), controllers.DownloadAttachment)
+
+	// Group Conversation Routes
+	app.Post("/api/conversations", middleware.RequireScope(models.ScopeConversationsWrite), controllers.CreateConversation)
+	app.Get("/api/conversations", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetConversations)
+	app.Get("/api/conversations/:conversationId", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetConversation)
+	app.Get("/api/conversations/:conversationId/messages", middleware.RequireScope(models.ScopeMessagesRead), controllers.GetMessages)
+	app.Post("/api/conversations/:conversationId/messages", middleware.RequireScope(models.ScopeMessagesWrite), middleware.RequireVerifiedEmail(), controllers.SendMessage)
+	app.Post("/api/conversations/:conversationId/read", middleware.RequireScope(models.ScopeMessagesWrite), controllers.MarkMessagesRead)
+	app.Post("/api/conversations/:conversationId/members", middleware.RequireScope(models.ScopeConversationsWrite), controllers.AddConversationMembers)
+	app.Delete("/api/conversations/:conversationId/members/:userId", middleware.RequireScope(models.ScopeConversationsWrite), controllers.RemoveConversationMember)
+	app.Put("/api/conversations/:conversationId/members/:userId/role", middleware.RequireScope(models.ScopeConversationsWrite), controllers.UpdateConversationMemberRole)
 }
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest stored file name, in bytes
+const maxFileNameLength = 255
+
+// Content types accepted when ATTACHMENT_ALLOWED_TYPES is unset. A trailing
+// "*" matches any suffix.
+var defaultAttachmentTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp",
+	"audio/*", "video/*",
+	"text/plain", "text/csv",
+	"application/pdf", "application/json",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-tar", "application/x-7z-compressed",
+	"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.*",
+	"application/vnd.oasis.opendocument.*",
+}
+
+// Content types a browser would render as an active document; a file name
+// is never allowed to turn an upload into one of these
+var scriptableTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/javascript":        true,
+	"application/javascript": true,
+}
+
+// AttachmentLimits bounds the files that can be attached to a message.
+//
+// Configuration: ATTACHMENT_MAX_SIZE_MB (per file, default 25),
+// ATTACHMENT_MAX_TOTAL_MB (per message, default 50), ATTACHMENT_MAX_COUNT
+// (per message, default 10), ATTACHMENT_ALLOWED_TYPES (comma separated
+// content types, "type/*" allowed) and VOICE_MESSAGE_MAX_DURATION (default
+// 5m).
+type AttachmentLimits struct {
+	MaxSize          int64
+	MaxTotalSize     int64
+	MaxCount         int
+	AllowedTypes     []string
+	MaxVoiceDuration time.Duration
+}
+
+// LoadAttachmentLimits reads the attachment limits from the environment
+func LoadAttachmentLimits() AttachmentLimits {
+	limits := AttachmentLimits{
+		MaxSize:          int64(GetEnvInt("ATTACHMENT_MAX_SIZE_MB", 25)) << 20,
+		MaxTotalSize:     int64(GetEnvInt("ATTACHMENT_MAX_TOTAL_MB", 50)) << 20,
+		MaxCount:         GetEnvInt("ATTACHMENT_MAX_COUNT", 10),
+		AllowedTypes:     defaultAttachmentTypes,
+		MaxVoiceDuration: GetEnvDuration("VOICE_MESSAGE_MAX_DURATION", 5*time.Minute),
+	}
+	if value := os.Getenv("ATTACHMENT_ALLOWED_TYPES"); value != "" {
+		limits.AllowedTypes = nil
+		for _, contentType := range strings.Split(value, ",") {
+			if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+				limits.AllowedTypes = append(limits.AllowedTypes, contentType)
+			}
+		}
+	}
+	return limits
+}
+
+// Allows reports whether files of the content type may be attached
+func (l AttachmentLimits) Allows(contentType string) bool {
+	for _, allowed := range l.AllowedTypes {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(contentType, prefix) {
+				return true
+			}
+		} else if contentType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestBodyLimit is the largest request body the server has to accept:
+// a message carrying the most attachments allowed, plus room for the rest
+// of the form
+func (l AttachmentLimits) RequestBodyLimit() int {
+	return int(l.MaxTotalSize) + 4<<20
+}
+
+// AttachmentContentType decides the content type of an upload from its
+// content. Binary containers such as zip are refined by the file extension
+// (.docx, .xlsx, ...), and plain text only into CSV, so a file name never
+// turns an upload into something a browser would execute.
+func AttachmentContentType(name string, data []byte) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if sniffed != "application/octet-stream" && sniffed != "application/zip" &&
+		sniffed != "text/plain" {
+		return sniffed
+	}
+
+	byExtension, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(path.Ext(name))))
+	if err != nil {
+		return sniffed
+	}
+	if sniffed == "text/plain" {
+		if byExtension == "text/csv" {
+			return byExtension
+		}
+		return sniffed
+	}
+	if strings.HasPrefix(byExtension, "text/") || scriptableTypes[byExtension] {
+		return sniffed
+	}
+	return byExtension
+}
+
+// SanitizeFileName reduces a client supplied file name to a safe base name
+func SanitizeFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(strings.ToValidUTF8(name, ""))
+
+	for len(name) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// InlineContentType reports whether files of the content type can safely be
+// shown in the browser rather than downloaded
+func InlineContentType(contentType string) bool {
+	switch {
+	case contentType == "image/png", contentType == "image/jpeg",
+		contentType == "image/gif", contentType == "image/webp":
+		return true
+	case strings.HasPrefix(contentType, "audio/"), strings.HasPrefix(contentType, "video/"):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func testZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create("index.html")
+	f.Write([]byte("<script>alert(1)</script>"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Uploads are served from our origin, so whatever the client names a file,
+// it must never come back as a document the browser would run
+func TestAttachmentContentTypeIgnoresScriptableNames(t *testing.T) {
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}
+	text := []byte("<svg onload=alert(1)></svg>")
+	archive := testZip(t)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"page.html", text, "text/plain"},
+		{"page.htm", text, "text/plain"},
+		{"image.svg", text, "text/plain"},
+		{"feed.xml", text, "text/plain"},
+		{"app.js", text, "text/plain"},
+		{"page.HTML", text, "text/plain"},
+		{"page.html", binary, "application/octet-stream"},
+		{"image.svg", binary, "application/octet-stream"},
+		{"app.js", binary, "application/octet-stream"},
+		{"page.html", archive, "application/zip"},
+		{"image.svg", archive, "application/zip"},
+		{"page.html", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	}
+	for _, tt := range tests {
+		if got := AttachmentContentType(tt.name, tt.data); got != tt.want {
+			t.Errorf("AttachmentContentType(%q, %.8q) = %q, want %q", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentContentTypeRefinesBinaries(t *testing.T) {
+	if got := AttachmentContentType("report.pdf", testZip(t)); got != "application/pdf" {
+		t.Errorf("zip named report.pdf = %q, want the type of its extension", got)
+	}
+	if got := AttachmentContentType("notes", []byte("hello")); got != "text/plain" {
+		t.Errorf("text without an extension = %q", got)
+	}
+}
@@ -0,0 +1,427 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Number of bars in a voice message waveform
+const waveformBars = 64
+
+// ErrInvalidAudio is returned for voice messages that are not Opus in an Ogg
+// or WebM container or PCM WAV, or are malformed
+var ErrInvalidAudio = errors.New("voice messages must be Opus (Ogg or WebM) or PCM WAV audio")
+
+// VoiceClip describes a validated voice message
+type VoiceClip struct {
+	ContentType string
+	Duration    time.Duration
+	// Waveform holds up to 64 loudness values from 0 to 255, in order
+	Waveform []int
+}
+
+// audioSegment is a stretch of audio with its loudness: the bitrate of an
+// Opus packet or the peak amplitude of PCM samples
+type audioSegment struct {
+	duration time.Duration
+	level    float64
+}
+
+// ProbeVoiceClip validates a voice message by parsing its container and
+// codec, and computes its duration and waveform. Opus is not decoded: the
+// size of each packet stands in for its loudness, which is what a variable
+// bitrate encoder spends bits on.
+func ProbeVoiceClip(data []byte) (VoiceClip, error) {
+	var (
+		clip     VoiceClip
+		segments []audioSegment
+		err      error
+	)
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		clip.ContentType = "audio/ogg"
+		segments, err = probeOggOpus(data)
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		clip.ContentType = "audio/webm"
+		segments, err = probeWebMOpus(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		clip.ContentType = "audio/wav"
+		segments, err = probeWAV(data)
+	default:
+		return clip, ErrInvalidAudio
+	}
+	if err != nil {
+		return clip, fmt.Errorf("%w: %v", ErrInvalidAudio, err)
+	}
+
+	for _, segment := range segments {
+		clip.Duration += segment.duration
+	}
+	if clip.Duration <= 0 {
+		return clip, fmt.Errorf("%w: no audio", ErrInvalidAudio)
+	}
+	clip.Waveform = waveform(segments, clip.Duration)
+	return clip, nil
+}
+
+// waveform spreads the segments over at most waveformBars bars and scales
+// the loudest to 255
+func waveform(segments []audioSegment, total time.Duration) []int {
+	bars := min(waveformBars, len(segments))
+	sums := make([]float64, bars)
+	weights := make([]float64, bars)
+
+	var start time.Duration
+	for _, segment := range segments {
+		bar := min(bars-1, int(int64(start)*int64(bars)/int64(total)))
+		sums[bar] += segment.level * float64(segment.duration)
+		weights[bar] += float64(segment.duration)
+		start += segment.duration
+	}
+
+	levels := make([]float64, bars)
+	low, high := math.Inf(1), 0.0
+	for i := range levels {
+		if weights[i] > 0 {
+			levels[i] = sums[i] / weights[i]
+		} else if i > 0 {
+			levels[i] = levels[i-1]
+		}
+		low, high = min(low, levels[i]), max(high, levels[i])
+	}
+
+	values := make([]int, bars)
+	for i, level := range levels {
+		if high > low {
+			values[i] = int(math.Round(255 * (level - low) / (high - low)))
+		}
+	}
+	return values
+}
+
+// opusPacketDuration reads the duration of an Opus packet from its TOC byte
+// (RFC 6716 section 3.1)
+func opusPacketDuration(packet []byte) (time.Duration, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("empty Opus packet")
+	}
+
+	config := packet[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12: // SILK: 10, 20, 40 or 60 ms
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // Hybrid: 10 or 20 ms
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT: 2.5, 5, 10 or 20 ms
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("truncated Opus packet")
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	duration := frame * time.Duration(frames)
+	if frames == 0 || duration > 120*time.Millisecond {
+		return 0, errors.New("invalid Opus packet")
+	}
+	return duration, nil
+}
+
+// opusSegment turns an Opus packet into a segment whose level is its bitrate
+func opusSegment(packet []byte) (audioSegment, error) {
+	duration, err := opusPacketDuration(packet)
+	if err != nil {
+		return audioSegment{}, err
+	}
+	return audioSegment{
+		duration: duration,
+		level:    float64(len(packet)) / duration.Seconds(),
+	}, nil
+}
+
+// probeOggOpus reads the packets of a single Opus stream in an Ogg container
+// (RFC 7845)
+func probeOggOpus(data []byte) ([]audioSegment, error) {
+	var (
+		segments []audioSegment
+		packet   []byte
+		serial   uint32
+		packets  int
+		preSkip  time.Duration
+	)
+
+	for offset := 0; offset < len(data); {
+		page := data[offset:]
+		if len(page) < 27 || string(page[:4]) != "OggS" || page[4] != 0 {
+			return nil, errors.New("malformed Ogg page")
+		}
+		pageSerial := binary.LittleEndian.Uint32(page[14:])
+		if offset == 0 {
+			serial = pageSerial
+		} else if pageSerial != serial {
+			return nil, errors.New("multiple Ogg streams")
+		}
+
+		count := int(page[26])
+		if len(page) < 27+count {
+			return nil, errors.New("truncated Ogg page")
+		}
+		lacing := page[27 : 27+count]
+		body := page[27+count:]
+		offset += 27 + count
+
+		for _, size := range lacing {
+			if len(body) < int(size) {
+				return nil, errors.New("truncated Ogg page")
+			}
+			packet = append(packet, body[:size]...)
+			body = body[size:]
+			offset += int(size)
+			if size == 255 {
+				// The packet continues in the next lacing value
+				continue
+			}
+
+			switch packets {
+			case 0:
+				if len(packet) < 19 || string(packet[:8]) != "OpusHead" {
+					return nil, errors.New("not an Opus stream")
+				}
+				preSkip = time.Duration(binary.LittleEndian.Uint16(packet[10:])) *
+					time.Second / 48000
+			case 1:
+				if !bytes.HasPrefix(packet, []byte("OpusTags")) {
+					return nil, errors.New("missing Opus tags")
+				}
+			default:
+				segment, err := opusSegment(packet)
+				if err != nil {
+					return nil, err
+				}
+				segments = append(segments, segment)
+			}
+			packets++
+			packet = nil
+		}
+	}
+
+	// Decoders drop the first pre-skip samples, which are encoder priming
+	for len(segments) > 0 && preSkip > 0 {
+		skipped := min(preSkip, segments[0].duration)
+		segments[0].duration -= skipped
+		preSkip -= skipped
+		if segments[0].duration == 0 {
+			segments = segments[1:]
+		}
+	}
+	return segments, nil
+}
+
+// Matroska element IDs used by probeWebMOpus
+const (
+	ebmlHeaderID  = 0x1A45DFA3
+	ebmlDocTypeID = 0x4282
+	segmentID     = 0x18538067
+	tracksID      = 0x1654AE6B
+	trackEntryID  = 0xAE
+	trackTypeID   = 0x83
+	codecIDID     = 0x86
+	clusterID     = 0x1F43B675
+	simpleBlockID = 0xA3
+	blockGroupID  = 0xA0
+	blockID       = 0xA1
+)
+
+// Elements probeWebMOpus looks inside of rather than skipping
+var webmContainers = map[uint64]bool{
+	ebmlHeaderID: true,
+	segmentID:    true,
+	tracksID:     true,
+	trackEntryID: true,
+	clusterID:    true,
+	blockGroupID: true,
+}
+
+// probeWebMOpus reads the Opus blocks of an audio-only WebM file. Elements
+// are walked in file order, entering containers instead of skipping them,
+// which also handles the unknown sizes live recorders write.
+func probeWebMOpus(data []byte) ([]audioSegment, error) {
+	var (
+		segments []audioSegment
+		docType  string
+		tracks   int
+		opus     = true
+	)
+
+	for offset := 0; offset < len(data); {
+		id, idLength, err := readEBMLVarint(data[offset:], true)
+		if err != nil {
+			return nil, err
+		}
+		size, sizeLength, err := readEBMLVarint(data[offset+idLength:], false)
+		if err != nil {
+			return nil, err
+		}
+		offset += idLength + sizeLength
+
+		if webmContainers[id] {
+			continue
+		}
+		if size == math.MaxUint64 || size > uint64(len(data)-offset) {
+			return nil, errors.New("truncated WebM element")
+		}
+		payload := data[offset : offset+int(size)]
+		offset += int(size)
+
+		switch id {
+		case ebmlDocTypeID:
+			docType = string(payload)
+		case trackTypeID:
+			tracks++
+			// Only audio tracks (type 2) are allowed
+			if len(payload) != 1 || payload[0] != 2 {
+				opus = false
+			}
+		case codecIDID:
+			if string(payload) != "A_OPUS" {
+				opus = false
+			}
+		case simpleBlockID, blockID:
+			// Track number, 16-bit timecode and flags precede the frame
+			_, trackLength, err := readEBMLVarint(payload, false)
+			if err != nil || len(payload) < trackLength+3 {
+				return nil, errors.New("malformed WebM block")
+			}
+			segment, err := opusSegment(payload[trackLength+3:])
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+		}
+	}
+
+	if docType != "webm" || tracks != 1 || !opus {
+		return nil, errors.New("not an Opus WebM stream")
+	}
+	return segments, nil
+}
+
+// readEBMLVarint reads an EBML variable length integer. IDs keep their
+// length marker; sizes drop it and return MaxUint64 when unknown.
+func readEBMLVarint(data []byte, keepMarker bool) (uint64, int, error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, errors.New("malformed WebM element")
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0, errors.New("malformed WebM element")
+	}
+
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	unknown := value == uint64(0xFF>>length)
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+		unknown = unknown && b == 0xFF
+	}
+	if unknown && !keepMarker {
+		return math.MaxUint64, length, nil
+	}
+	return value, length, nil
+}
+
+// probeWAV reads a PCM WAV file, measuring the peak amplitude of every
+// 20 ms of audio
+func probeWAV(data []byte) ([]audioSegment, error) {
+	var (
+		channels, bitsPerSample int
+		sampleRate              int
+		samples                 []byte
+		haveFormat              bool
+	)
+
+	for offset := 12; offset+8 <= len(data); {
+		chunkID := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		offset += 8
+		if size < 0 || size > len(data)-offset {
+			return nil, errors.New("truncated WAV chunk")
+		}
+		chunk := data[offset : offset+size]
+		// Chunks are padded to an even size
+		offset += size + size%2
+
+		switch chunkID {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return nil, errors.New("malformed WAV format")
+			}
+			format := binary.LittleEndian.Uint16(chunk)
+			// WAVE_FORMAT_EXTENSIBLE names the real format in its sub-format GUID
+			if format == 0xFFFE && len(chunk) >= 26 {
+				format = binary.LittleEndian.Uint16(chunk[24:])
+			}
+			if format != 1 {
+				return nil, errors.New("WAV audio must be PCM")
+			}
+			channels = int(binary.LittleEndian.Uint16(chunk[2:]))
+			sampleRate = int(binary.LittleEndian.Uint32(chunk[4:]))
+			bitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:]))
+			haveFormat = true
+		case "data":
+			samples = chunk
+		}
+	}
+
+	if !haveFormat || samples == nil {
+		return nil, errors.New("missing WAV format or data")
+	}
+	if channels < 1 || channels > 8 || sampleRate < 8000 || sampleRate > 192000 ||
+		(bitsPerSample != 8 && bitsPerSample != 16) {
+		return nil, errors.New("unsupported WAV format")
+	}
+
+	frameSize := channels * bitsPerSample / 8
+	framesPerSegment := sampleRate / 50
+	var segments []audioSegment
+	for start := 0; start+frameSize <= len(samples); start += framesPerSegment * frameSize {
+		end := min(len(samples), start+framesPerSegment*frameSize)
+		end -= (end - start) % frameSize
+
+		peak := 0.0
+		for i := start; i < end; i += bitsPerSample / 8 {
+			var sample float64
+			if bitsPerSample == 8 {
+				// 8-bit PCM is unsigned
+				sample = float64(int(samples[i])-128) / 128
+			} else {
+				sample = float64(int16(binary.LittleEndian.Uint16(samples[i:]))) / 32768
+			}
+			peak = max(peak, math.Abs(sample))
+		}
+
+		segments = append(segments, audioSegment{
+			duration: time.Duration(end-start) / time.Duration(frameSize) *
+				time.Second / time.Duration(sampleRate),
+			level: peak,
+		})
+	}
+	return segments, nil
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A 20 ms CELT frame, the smallest valid Opus packet
+var opusFrame = []byte{31 << 3, 0x55, 0x55}
+
+var opusHead = append([]byte("OpusHead"), 1, 1, 0, 0, 0x80, 0xBB, 0, 0, 0, 0, 0)
+
+func oggPage(serial uint32, packets ...[]byte) []byte {
+	page := []byte("OggS")
+	page = append(page, 0, 0)
+	page = append(page, make([]byte, 8)...) // granule position
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = append(page, make([]byte, 8)...) // sequence number and checksum
+	page = append(page, byte(len(packets)))
+	for _, packet := range packets {
+		page = append(page, byte(len(packet)))
+	}
+	for _, packet := range packets {
+		page = append(page, packet...)
+	}
+	return page
+}
+
+// oggOpus builds a one second Ogg Opus file, with the given header packets
+func oggOpus(head, tags []byte, frame []byte) []byte {
+	frames := make([][]byte, 50)
+	for i := range frames {
+		frames[i] = frame
+	}
+	data := oggPage(1, head)
+	data = append(data, oggPage(1, tags)...)
+	return append(data, oggPage(1, frames...)...)
+}
+
+// ebml encodes an element, with its size on two bytes
+func ebml(id uint64, payload ...[]byte) []byte {
+	content := bytes.Join(payload, nil)
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+	element = append(element, 0x40|byte(len(content)>>8), byte(len(content)))
+	return append(element, content...)
+}
+
+// webmOpus builds a one second WebM file with a single track
+func webmOpus(docType string, trackType byte, codec string, frame []byte) []byte {
+	blocks := make([][]byte, 50)
+	for i := range blocks {
+		blocks[i] = ebml(simpleBlockID, []byte{0x81, 0, 0, 0x80}, frame)
+	}
+	return append(ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte(docType))),
+		ebml(segmentID,
+			ebml(tracksID, ebml(trackEntryID,
+				ebml(trackTypeID, []byte{trackType}),
+				ebml(codecIDID, []byte(codec)))),
+			ebml(clusterID, blocks...))...)
+}
+
+func wavChunk(id string, data []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(data)))
+	return append(chunk, data...)
+}
+
+func wavFormat(format, channels uint16, sampleRate uint32, bitsPerSample uint16) []byte {
+	chunk := binary.LittleEndian.AppendUint16(nil, format)
+	chunk = binary.LittleEndian.AppendUint16(chunk, channels)
+	chunk = binary.LittleEndian.AppendUint32(chunk, sampleRate)
+	blockAlign := channels * bitsPerSample / 8
+	chunk = binary.LittleEndian.AppendUint32(chunk, sampleRate*uint32(blockAlign))
+	chunk = binary.LittleEndian.AppendUint16(chunk, blockAlign)
+	return wavChunk("fmt ", binary.LittleEndian.AppendUint16(chunk, bitsPerSample))
+}
+
+func wav(chunks ...[]byte) []byte {
+	body := append([]byte("WAVE"), bytes.Join(chunks, nil)...)
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+// One second of 16-bit mono audio at 8 kHz
+var wavSamples = make([]byte, 2*8000)
+
+func TestProbeVoiceClip(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+	}{
+		{"ogg", oggOpus(opusHead, []byte("OpusTags"), opusFrame), "audio/ogg"},
+		{"webm", webmOpus("webm", 2, "A_OPUS", opusFrame), "audio/webm"},
+		{"wav", wav(wavFormat(1, 1, 8000, 16), wavChunk("data", wavSamples)), "audio/wav"},
+	}
+	for _, tt := range tests {
+		clip, err := ProbeVoiceClip(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if clip.ContentType != tt.contentType || clip.Duration != time.Second ||
+			len(clip.Waveform) != 50 {
+			t.Errorf("%s: %s, %v, %d bars", tt.name, clip.ContentType, clip.Duration, len(clip.Waveform))
+		}
+	}
+}
+
+func TestProbeVoiceClipRefusesMalformed(t *testing.T) {
+	ogg := oggOpus(opusHead, []byte("OpusTags"), opusFrame)
+	webm := webmOpus("webm", 2, "A_OPUS", opusFrame)
+	secondStream := append(oggPage(1, opusHead), oggPage(2, []byte("OpusTags"))...)
+	badVersion := bytes.Clone(ogg)
+	badVersion[4] = 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown container", []byte("ID3\x04\x00\x00\x00\x00\x00\x00")},
+
+		{"ogg truncated", ogg[:len(ogg)-10]},
+		{"ogg truncated header", ogg[:20]},
+		{"ogg unknown version", badVersion},
+		{"ogg with two streams", secondStream},
+		{"ogg vorbis", oggOpus(append([]byte("\x01vorbis"), make([]byte, 23)...), []byte("OpusTags"), opusFrame)},
+		{"ogg short head", oggOpus([]byte("OpusHead"), []byte("OpusTags"), opusFrame)},
+		{"ogg without tags", oggOpus(opusHead, []byte("Comments"), opusFrame)},
+		{"ogg empty packet", oggOpus(opusHead, []byte("OpusTags"), []byte{})},
+		{"ogg no frames in packet", oggOpus(opusHead, []byte("OpusTags"), []byte{31<<3 | 3, 0})},
+		{"ogg headers only", append(oggPage(1, opusHead), oggPage(1, []byte("OpusTags"))...)},
+
+		{"webm truncated", webm[:len(webm)-5]},
+		{"webm zero byte id", append(bytes.Clone(webm), 0)},
+		{"webm matroska", webmOpus("matroska", 2, "A_OPUS", opusFrame)},
+		{"webm video track", webmOpus("webm", 1, "A_OPUS", opusFrame)},
+		{"webm vorbis", webmOpus("webm", 2, "A_VORBIS", opusFrame)},
+		{"webm too many frames", webmOpus("webm", 2, "A_OPUS", []byte{31<<3 | 3, 7})},
+		{"webm without tracks", ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte("webm")))},
+
+		{"wav truncated", wav(wavFormat(1, 1, 8000, 16), wavChunk("data", wavSamples))[:1000]},
+		{"wav float", wav(wavFormat(3, 1, 8000, 16), wavChunk("data", wavSamples))},
+		{"wav 24-bit", wav(wavFormat(1, 1, 8000, 24), wavChunk("data", wavSamples))},
+		{"wav no channels", wav(wavFormat(1, 0, 8000, 16), wavChunk("data", wavSamples))},
+		{"wav low sample rate", wav(wavFormat(1, 1, 4000, 16), wavChunk("data", wavSamples))},
+		{"wav short format", wav(wavChunk("fmt ", []byte{1, 0}), wavChunk("data", wavSamples))},
+		{"wav without format", wav(wavChunk("data", wavSamples))},
+		{"wav without data", wav(wavFormat(1, 1, 8000, 16))},
+		{"wav empty data", wav(wavFormat(1, 1, 8000, 16), wavChunk("data", []byte{}))},
+	}
+	for _, tt := range tests {
+		if _, err := ProbeVoiceClip(tt.data); !errors.Is(err, ErrInvalidAudio) {
+			t.Errorf("%s: %v, want ErrInvalidAudio", tt.name, err)
+		}
+	}
+}
@@ -1,14 +1,25 @@
 package utils
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 
 	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/cloudinary/cloudinary-go/v2/api"
+	"github.com/cloudinary/cloudinary-go/v2/api/admin"
 	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
 )
 
+// Root folder in Cloudinary; storage keys are nested below it
+const cloudinaryFolder = "insta"
+
 type CloudinaryService struct {
 	cloudinary *cloudinary.Cloudinary
 }
@@ -28,30 +39,91 @@ func NewCloudinaryService() (
 	return &CloudinaryService{cloudinary: cld}, nil
 }
 
-// Upload an image to Cloudinary
-func (cs *CloudinaryService) UploadImage(ctx context.Context,
-	filePath string) (string, error) {
+// Put uploads a file to Cloudinary
+func (cs *CloudinaryService) Put(ctx context.Context, key, contentType string,
+	data []byte) (string, error) {
 	uploadParams := uploader.UploadParams{
-		Folder: "insta", // define a specific folder in Cloudinary
+		PublicID:     publicIDForKey(key),
+		ResourceType: "auto", // images as well as any other file type
 	}
 
-	resp, err := cs.cloudinary.Upload.Upload(ctx, filePath, uploadParams)
+	resp, err := cs.cloudinary.Upload.Upload(ctx, bytes.NewReader(data), uploadParams)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload image to Cloudinary: %w", err)
+		return "", fmt.Errorf("failed to upload file to Cloudinary: %w", err)
+	}
+	if resp.Error.Message != "" {
+		return "", fmt.Errorf("failed to upload file to Cloudinary: %s", resp.Error.Message)
 	}
 
 	return resp.SecureURL, nil
 }
 
-// Delete an image from Cloudinary
-func (cs *CloudinaryService) DeleteImage(ctx context.Context,
-	publicID string) error {
+// Open downloads a file from Cloudinary. Uploads use the "auto" resource
+// type, so the asset is looked up under each type until it is found.
+func (cs *CloudinaryService) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	var secureURL string
+	for _, assetType := range []api.AssetType{api.Image, api.Video, api.File} {
+		asset, err := cs.cloudinary.Admin.Asset(ctx, admin.AssetParams{
+			AssetType: assetType,
+			PublicID:  publicIDForKey(key),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up file in Cloudinary: %w", err)
+		}
+		if asset.Error.Message == "" && asset.SecureURL != "" {
+			secureURL = asset.SecureURL
+			break
+		}
+	}
+	if secureURL == "" {
+		return nil, fmt.Errorf("file %q not found in Cloudinary", key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, secureURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file from Cloudinary: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download file from Cloudinary: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes a file from Cloudinary
+func (cs *CloudinaryService) Delete(ctx context.Context, key string) error {
 	_, err := cs.cloudinary.Upload.Destroy(ctx, uploader.DestroyParams{
-		PublicID: publicID,
+		PublicID: publicIDForKey(key),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete image from Cloudinary: %w", err)
+		return fmt.Errorf("failed to delete file from Cloudinary: %w", err)
 	}
 
 	return nil
 }
+
+// Matches the part after the optional version in a delivery URL:
+// https://res.cloudinary.com/<cloud-name>/image/upload/v1234567890/<public id>.<ext>
+var cloudinaryURLPattern = regexp.MustCompile(`/upload/(?:v\d+/)?(.+)$`)
+
+// KeyFromURL extracts the storage key from a Cloudinary delivery URL
+func (cs *CloudinaryService) KeyFromURL(url string) string {
+	if !strings.Contains(url, "res.cloudinary.com") {
+		return ""
+	}
+	match := cloudinaryURLPattern.FindStringSubmatch(url)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimPrefix(match[1], cloudinaryFolder+"/")
+}
+
+// publicIDForKey maps a storage key to a Cloudinary public ID, which lives
+// under the root folder and carries no extension
+func publicIDForKey(key string) string {
+	return cloudinaryFolder + "/" + strings.TrimSuffix(key, path.Ext(key))
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetEnvDuration reads a duration such as "15m" from the environment,
+// falling back to def when the variable is unset or malformed
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %v, using %s", key, err, def)
+		return def
+	}
+	return d
+}
+
+// GetEnvInt reads an integer from the environment, falling back to def
+// when the variable is unset or malformed
+func GetEnvInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %v, using %d", key, err, def)
+		return def
+	}
+	return n
+}
+
+// GetEnvBool reads a boolean such as "true" or "0" from the environment,
+// falling back to def when the variable is unset or malformed
+func GetEnvBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %v, using %t", key, err, def)
+		return def
+	}
+	return b
+}
@@ -2,38 +2,44 @@ package utils
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"os"
 	"time"
 
+	"github.com/chat-app/models"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 const CookieName = "auth_token"
 
-// CreateJWT generates a JWT token and sets it in a cookie
-func CreateJWT(c *fiber.Ctx, userID uint, username string) (string, error) {
-	// Load the secret key from the environment variable
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		return "", fmt.Errorf("JWT_SECRET is not set in environment variables")
-	}
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Token types, in the typ claim. Only access tokens grant access; the others
+// are internal and signed with a key that is not published.
+const (
+	tokenTypeAccess    = "access"
+	tokenTypeChallenge = "2fa_challenge"
+	tokenTypeOIDCState = "oidc_state"
+)
+
+// CreateJWT generates a short-lived access token for a session and sets it
+// in a cookie
+func CreateJWT(c *fiber.Ctx, userID uint, username string, sessionID uint) (string, error) {
+	expiresAt := time.Now().Add(AccessTokenTTL())
 
 	// Define token claims
 	claims := jwt.MapClaims{
+		"typ":      tokenTypeAccess,
 		"id":       userID,
 		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
-		"iat":      time.Now().Unix(),                     // Issued at
+		"sid":      sessionID,         // Session the token belongs to
+		"exp":      expiresAt.Unix(),  // Short-lived; renewed with the refresh token
+		"iat":      time.Now().Unix(), // Issued at
 	}
 
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign the token with the secret key
-	signedToken, err := token.SignedString([]byte(secretKey))
+	// Sign the token with the current key
+	signedToken, err := AuthTokens.Sign(claims)
 	if err != nil {
 		log.Printf("Error signing JWT token: %v", err)
 		return "", err
@@ -46,7 +52,7 @@ func CreateJWT(c *fiber.Ctx, userID uint, username string) (string, error) {
 	c.Cookie(&fiber.Cookie{
 		Name:     CookieName,  // Cookie name
 		Value:    signedToken, // JWT token value
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  expiresAt,
 		HTTPOnly: true,         // Prevent JavaScript access
 		Secure:   isProduction, // Use secure cookies in production
 		SameSite: "Strict",     // SameSite policy (prevent CSRF attacks)
@@ -55,41 +61,97 @@ func CreateJWT(c *fiber.Ctx, userID uint, username string) (string, error) {
 	return signedToken, nil
 }
 
-// ValidateToken validates a JWT token and extracts the claims
+// How long the second login step may take
+const challengeTokenTTL = 5 * time.Minute
+
+// CreateChallengeToken issues the short-lived token that proves the password
+// step of a two-factor login succeeded. It is not an access token, and is
+// signed with the internal key so nothing verifying access tokens accepts it.
+func CreateChallengeToken(userID uint) (string, error) {
+	claims := jwt.MapClaims{
+		"typ": tokenTypeChallenge,
+		"id":  userID,
+		"exp": time.Now().Add(challengeTokenTTL).Unix(),
+		"iat": time.Now().Unix(),
+	}
+
+	return AuthTokens.SignInternal(claims)
+}
+
+// ValidateChallengeToken checks a challenge token and returns its user ID
+func ValidateChallengeToken(tokenString string) (uint, error) {
+	claims, err := parseInternalToken(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	if claims["typ"] != tokenTypeChallenge {
+		return 0, errors.New("not a challenge token")
+	}
+	userID, ok := claims["id"].(float64)
+	if !ok {
+		return 0, errors.New("invalid user ID in token claims")
+	}
+	return uint(userID), nil
+}
+
+// ValidateToken validates an access token and extracts the claims
 func ValidateToken(tokenString string) (jwt.MapClaims, error) {
-	// Load the secret key from environment variables
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		return nil, errors.New("JWT_SECRET is not set in environment variables")
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims["typ"] != tokenTypeAccess {
+		return nil, errors.New("not an access token")
 	}
+	return claims, nil
+}
 
-	// Parse the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Ensure the signing method is HMAC
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secretKey), nil
-	})
+// AuthenticateAccessToken is the single check behind every authenticated
+// request and WebSocket connection: the token must be a valid access token
+// whose session is still active. It returns the user ID and the session.
+func AuthenticateAccessToken(tokenString string) (uint, models.Session, error) {
+	claims, err := ValidateToken(tokenString)
+	if err != nil {
+		return 0, models.Session{}, ErrInvalidToken
+	}
+
+	// Use float64 because JWT encodes numbers as float64
+	userID, ok := claims["id"].(float64)
+	if !ok {
+		return 0, models.Session{}, ErrInvalidToken
+	}
+	sessionID, ok := claims["sid"].(float64)
+	if !ok {
+		return 0, models.Session{}, ErrInvalidToken
+	}
 
-	// Handle token parsing errors
+	// Reject tokens whose session was revoked or has expired
+	session, err := LoadActiveSession(uint(sessionID))
+	if err != nil {
+		return 0, session, err
+	}
+	if session.UserID != uint(userID) {
+		return 0, session, ErrSessionInvalid
+	}
+	return uint(userID), session, nil
+}
+
+// parseToken validates an access token and extracts the claims
+func parseToken(tokenString string) (jwt.MapClaims, error) {
+	claims, err := AuthTokens.Parse(tokenString)
 	if err != nil {
 		log.Printf("Error parsing JWT token: %v", err)
 		return nil, err
 	}
+	return claims, nil
+}
 
-	// Validate the token claims
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// Ensure the token is not expired
-		exp, ok := claims["exp"].(float64)
-		if !ok {
-			return nil, errors.New("invalid expiration claim in token")
-		}
-		if time.Now().Unix() > int64(exp) {
-			return nil, errors.New("token is expired")
-		}
-		return claims, nil
+// parseInternalToken validates a token signed with the internal key
+func parseInternalToken(tokenString string) (jwt.MapClaims, error) {
+	claims, err := AuthTokens.ParseInternal(tokenString)
+	if err != nil {
+		log.Printf("Error parsing internal token: %v", err)
+		return nil, err
 	}
-
-	return nil, errors.New("invalid token")
+	return claims, nil
 }
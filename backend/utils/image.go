@@ -0,0 +1,448 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder
+)
+
+// Quality of re-encoded JPEGs: full size images and the smaller renditions
+const (
+	jpegQuality          = 90
+	jpegRenditionQuality = 80
+)
+
+// ErrInvalidImage is returned for uploads that do not decode as a supported
+// image (JPEG, PNG, GIF or WebP) or are too large to process
+var ErrInvalidImage = errors.New("file is not a supported image")
+
+// ImageRendition is one encoded size of an image
+type ImageRendition struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// ProcessedImage is an upload after ProcessImage. Preview and Thumbnail are
+// nil when the image is already small enough to be shown as it is.
+type ProcessedImage struct {
+	Original  ImageRendition
+	Preview   *ImageRendition
+	Thumbnail *ImageRendition
+}
+
+// StoredImage holds the URLs of a processed image's renditions. The preview
+// and thumbnail URLs fall back to the next larger rendition. Keys are the
+// storage keys of the renditions, for DeleteImageKeys.
+type StoredImage struct {
+	URL          string
+	PreviewURL   string
+	ThumbnailURL string
+	Keys         []string
+}
+
+// Most frames accepted in an animated GIF
+const gifMaxFrames = 1000
+
+// ProcessImage validates an uploaded image by decoding it, turns it upright
+// according to its EXIF orientation and re-encodes it, which drops all
+// metadata (EXIF including GPS, XMP, comments). It also renders the preview
+// and thumbnail sizes.
+//
+// Configuration: IMAGE_PREVIEW_SIZE (longest side, default 1280),
+// IMAGE_THUMBNAIL_SIZE (default 320) and IMAGE_MAX_PIXELS (largest image
+// accepted, default 50 megapixels; for GIFs, all frames together).
+func ProcessImage(data []byte) (ProcessedImage, error) {
+	original, still, err := cleanImage(data)
+	if err != nil {
+		return ProcessedImage{}, err
+	}
+	processed := ProcessedImage{Original: original}
+
+	bounds := still.Bounds()
+	for _, size := range []struct {
+		maxSide   int
+		rendition **ImageRendition
+	}{
+		{GetEnvInt("IMAGE_PREVIEW_SIZE", 1280), &processed.Preview},
+		{GetEnvInt("IMAGE_THUMBNAIL_SIZE", 320), &processed.Thumbnail},
+	} {
+		if max(bounds.Dx(), bounds.Dy()) <= size.maxSide {
+			continue
+		}
+		rendition, err := encodeRendition(scaleImage(still, size.maxSide),
+			processed.Original.ContentType == "image/png", jpegRenditionQuality)
+		if err != nil {
+			return ProcessedImage{}, err
+		}
+		*size.rendition = &rendition
+	}
+
+	return processed, nil
+}
+
+// CleanImage re-encodes an image like ProcessImage, dropping its metadata,
+// without rendering the smaller sizes. Used for images sent as attachments.
+func CleanImage(data []byte) (ImageRendition, error) {
+	original, _, err := cleanImage(data)
+	return original, err
+}
+
+// cleanImage decodes, orients and re-encodes an image. It also returns the
+// still image (the first frame of animations) the smaller sizes are made of.
+func cleanImage(data []byte) (ImageRendition, image.Image, error) {
+	// Check the size before decoding so small files cannot claim huge images
+	maxPixels := int64(GetEnvInt("IMAGE_MAX_PIXELS", 50_000_000))
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageRendition{}, nil, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 ||
+		int64(config.Width)*int64(config.Height) > maxPixels {
+		return ImageRendition{}, nil, ErrInvalidImage
+	}
+
+	if format == "gif" {
+		// Every frame is decoded, so a small file of many highly compressed
+		// frames must not get that far
+		frames, pixels, err := gifFrameSizes(data)
+		if err != nil || frames > gifMaxFrames || pixels > maxPixels {
+			return ImageRendition{}, nil, ErrInvalidImage
+		}
+
+		// Keep animations; GIFs carry no orientation
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return ImageRendition{}, nil, ErrInvalidImage
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, animation); err != nil {
+			return ImageRendition{}, nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+		original := ImageRendition{
+			Data:        buf.Bytes(),
+			ContentType: "image/gif",
+			Width:       config.Width,
+			Height:      config.Height,
+		}
+		// The smaller sizes show the first frame on the full canvas
+		canvas := image.NewNRGBA(image.Rect(0, 0, config.Width, config.Height))
+		first := animation.Image[0]
+		draw.Draw(canvas, first.Bounds(), first, first.Bounds().Min, draw.Over)
+		return original, canvas, nil
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ImageRendition{}, nil, ErrInvalidImage
+	}
+	still := orientImage(toNRGBA(decoded), exifOrientation(data))
+
+	// WebP cannot be encoded in pure Go and becomes PNG or JPEG
+	original, err := encodeRendition(still, format == "png", jpegQuality)
+	if err != nil {
+		return ImageRendition{}, nil, err
+	}
+	return original, still, nil
+}
+
+// StoreImage processes an uploaded image and stores its renditions in
+// folder, next to each other: <key>.jpg, <key>-preview.jpg and
+// <key>-thumb.jpg. Returns ErrInvalidImage for anything but a valid image.
+func StoreImage(ctx context.Context, folder string, data []byte) (StoredImage, error) {
+	processed, err := ProcessImage(data)
+	if err != nil {
+		return StoredImage{}, err
+	}
+
+	original := processed.Original
+	key := NewStorageKey(folder, ExtensionForContentType(original.ContentType))
+	base := strings.TrimSuffix(key, path.Ext(key))
+
+	var stored StoredImage
+	var keys []string
+	put := func(key string, rendition ImageRendition) (string, error) {
+		url, err := MediaStorage.Put(ctx, key, rendition.ContentType, rendition.Data)
+		if err == nil {
+			keys = append(keys, key)
+		}
+		return url, err
+	}
+
+	stored.URL, err = put(key, original)
+	if err == nil && processed.Preview != nil {
+		stored.PreviewURL, err = put(base+"-preview"+
+			ExtensionForContentType(processed.Preview.ContentType), *processed.Preview)
+	}
+	if err == nil && processed.Thumbnail != nil {
+		stored.ThumbnailURL, err = put(base+"-thumb"+
+			ExtensionForContentType(processed.Thumbnail.ContentType), *processed.Thumbnail)
+	}
+	if err != nil {
+		for _, key := range keys {
+			MediaStorage.Delete(ctx, key)
+		}
+		return StoredImage{}, err
+	}
+
+	if stored.PreviewURL == "" {
+		stored.PreviewURL = stored.URL
+	}
+	if stored.ThumbnailURL == "" {
+		stored.ThumbnailURL = stored.PreviewURL
+	}
+	stored.Keys = keys
+	return stored, nil
+}
+
+// DeleteImageKeys removes the renditions of an image stored by StoreImage
+func DeleteImageKeys(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := MediaStorage.Delete(ctx, key); err != nil {
+			log.Println("Error deleting image:", err)
+		}
+	}
+}
+
+// DeleteStoredImage removes every rendition of a stored image. URLs that
+// do not belong to the storage backend, or repeat, are skipped.
+func DeleteStoredImage(ctx context.Context, urls ...string) {
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		key := MediaStorage.KeyFromURL(url)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if err := MediaStorage.Delete(ctx, key); err != nil {
+			log.Println("Error deleting image:", err)
+		}
+	}
+}
+
+// encodeRendition encodes an image as PNG when it has transparency or asPNG
+// is set, and as JPEG otherwise
+func encodeRendition(img image.Image, asPNG bool, quality int) (ImageRendition, error) {
+	var buf bytes.Buffer
+	rendition := ImageRendition{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+
+	opaque, ok := img.(interface{ Opaque() bool })
+	if asPNG || (ok && !opaque.Opaque()) {
+		rendition.ContentType = "image/png"
+		if err := png.Encode(&buf, img); err != nil {
+			return rendition, fmt.Errorf("failed to encode image: %w", err)
+		}
+	} else {
+		rendition.ContentType = "image/jpeg"
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return rendition, fmt.Errorf("failed to encode image: %w", err)
+		}
+	}
+
+	rendition.Data = buf.Bytes()
+	return rendition, nil
+}
+
+// scaleImage shrinks an image so its longest side is maxSide pixels
+func scaleImage(img image.Image, maxSide int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = max(1, height*maxSide/width)
+		width = maxSide
+	} else {
+		width = max(1, width*maxSide/height)
+		height = maxSide
+	}
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return scaled
+}
+
+// toNRGBA copies an image into an NRGBA image with its origin at 0,0
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	converted := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(converted, converted.Bounds(), img, bounds.Min, draw.Src)
+	return converted
+}
+
+// orientImage applies an EXIF orientation (1-8), returning an image that
+// displays upright without it
+func orientImage(img *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	// Orientations 5-8 swap the axes
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° counterclockwise, needs 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90° clockwise, needs 90° counterclockwise
+				dx, dy = y, width-1-x
+			}
+			src := img.PixOffset(x, y)
+			dst := out.PixOffset(dx, dy)
+			copy(out.Pix[dst:dst+4], img.Pix[src:src+4])
+		}
+	}
+	return out
+}
+
+// exifOrientation reads the orientation tag from a JPEG's EXIF segment,
+// returning 1 (upright) when there is none
+func exifOrientation(data []byte) int {
+	const orientationTag = 0x0112
+
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Walk the marker segments up to the start of the image data
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		i += 2 + length
+
+		tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00"))
+		if marker != 0xE1 || !ok || len(tiff) < 8 {
+			continue
+		}
+
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 1
+		}
+
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd < 8 || ifd+2 > len(tiff) {
+			return 1
+		}
+		entries := int(order.Uint16(tiff[ifd:]))
+		for e := 0; e < entries; e++ {
+			entry := ifd + 2 + e*12
+			if entry+12 > len(tiff) {
+				return 1
+			}
+			if order.Uint16(tiff[entry:]) == orientationTag {
+				return int(order.Uint16(tiff[entry+8:]))
+			}
+		}
+		return 1
+	}
+	return 1
+}
+
+// gifFrameSizes walks the blocks of a GIF without decompressing anything
+// and returns its number of frames and their total area in pixels
+func gifFrameSizes(data []byte) (frames int, pixels int64, err error) {
+	errTruncated := errors.New("gif: truncated or malformed")
+
+	// Header and logical screen descriptor, then the global color table
+	if len(data) < 13 {
+		return 0, 0, errTruncated
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	// skipSubBlocks moves past a chain of data sub-blocks ended by a 0 size
+	skipSubBlocks := func() bool {
+		for i < len(data) {
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return true
+			}
+			i += size
+		}
+		return false
+	}
+
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i += 2
+			if !skipSubBlocks() {
+				return 0, 0, errTruncated
+			}
+		case 0x2C: // image descriptor
+			if i+10 > len(data) {
+				return 0, 0, errTruncated
+			}
+			width := binary.LittleEndian.Uint16(data[i+5:])
+			height := binary.LittleEndian.Uint16(data[i+7:])
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data
+			i++
+			if !skipSubBlocks() {
+				return 0, 0, errTruncated
+			}
+			frames++
+			pixels += int64(width) * int64(height)
+		case 0x3B: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, errTruncated
+		}
+	}
+	// The decoder accepts a missing trailer
+	return frames, pixels, nil
+}
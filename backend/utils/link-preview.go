@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"gorm.io/gorm/clause"
+)
+
+// Most of a page read when looking for its metadata; the head comes first
+const linkPreviewMaxBody = 512 << 10
+
+// Longest title and description kept, in characters
+const (
+	linkPreviewMaxTitle       = 300
+	linkPreviewMaxDescription = 1000
+)
+
+// LinkPreviewHTTPClient fetches pages for link previews. When nil, a client
+// that refuses private, loopback and link-local addresses is used; tests
+// point it at a local stand-in.
+var LinkPreviewHTTPClient *http.Client
+
+// The default client, created on first use. It only connects to the web's
+// ports, 80 and 443, since a page on any other port of a public host is
+// more likely a service that was never meant to be fetched. Setting
+// LINK_PREVIEW_ALLOW_PRIVATE=true lifts all restrictions for local
+// development.
+var defaultLinkPreviewClient = sync.OnceValue(func() *http.Client {
+	return NewPublicHTTPClient(GetEnvBool("LINK_PREVIEW_ALLOW_PRIVATE", false), "80", "443")
+})
+
+// Matches http(s) URLs in message text, up to whitespace or a closing
+// bracket; trailing punctuation is trimmed separately
+var messageURLPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'()\[\]{}]+`)
+
+// FirstURL returns the first http(s) URL in a message text, or ""
+func FirstURL(text string) string {
+	match := messageURLPattern.FindString(text)
+	// Punctuation ending a sentence is not part of the link
+	match = strings.TrimRight(match, ".,;:!?")
+	if _, err := url.ParseRequestURI(match); err != nil || len(match) > 2048 {
+		return ""
+	}
+	return match
+}
+
+// LinkPreviewFor returns the preview of a URL, from the cache when it is
+// fresh (LINK_PREVIEW_TTL, default 24h; failures are retried after an hour)
+// and fetched otherwise. The preview has Failed set when the page could not
+// be fetched or carries no metadata.
+func LinkPreviewFor(ctx context.Context, rawURL string) (models.LinkPreview, error) {
+	var cached models.LinkPreview
+	err := database.DB.Where("url = ?", rawURL).Limit(1).Find(&cached).Error
+	if err != nil {
+		return cached, err
+	}
+
+	ttl := GetEnvDuration("LINK_PREVIEW_TTL", 24*time.Hour)
+	if cached.Failed {
+		ttl = min(ttl, time.Hour)
+	}
+	if cached.ID != 0 && time.Since(cached.FetchedAt) < ttl {
+		return cached, nil
+	}
+
+	preview, err := FetchLinkPreview(ctx, rawURL)
+	if err != nil {
+		preview = models.LinkPreview{URL: rawURL, Failed: true}
+	}
+	preview.FetchedAt = time.Now()
+
+	// Another message with the same link may have fetched it meanwhile
+	if err := database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "url"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"title", "description", "image_url", "site_name", "failed",
+			"fetched_at", "updated_at",
+		}),
+	}).Create(&preview).Error; err != nil {
+		return preview, err
+	}
+	return preview, nil
+}
+
+// FetchLinkPreview downloads an HTML page and reads its OpenGraph metadata,
+// falling back to the title and description meta tags
+func FetchLinkPreview(ctx context.Context, rawURL string) (models.LinkPreview, error) {
+	preview := models.LinkPreview{URL: rawURL}
+
+	client := LinkPreviewHTTPClient
+	if client == nil {
+		client = defaultLinkPreviewClient()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", "chat-app-link-preview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return preview, fmt.Errorf("unsupported content type %q", contentType)
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, linkPreviewMaxBody), contentType)
+	if err != nil {
+		return preview, err
+	}
+	meta := readPageMetadata(body)
+
+	preview.Title = firstNonEmpty(meta["og:title"], meta["twitter:title"], meta["title"])
+	preview.Description = firstNonEmpty(meta["og:description"],
+		meta["twitter:description"], meta["description"])
+	preview.SiteName = meta["og:site_name"]
+	preview.Title = truncateText(preview.Title, linkPreviewMaxTitle)
+	preview.Description = truncateText(preview.Description, linkPreviewMaxDescription)
+
+	// Relative image URLs are resolved against the final page URL
+	if image := firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); image != "" {
+		if imageURL, err := resp.Request.URL.Parse(image); err == nil &&
+			(imageURL.Scheme == "http" || imageURL.Scheme == "https") {
+			preview.ImageURL = imageURL.String()
+		}
+	}
+
+	if preview.Title == "" && preview.Description == "" {
+		return preview, errors.New("page has no title or description")
+	}
+	return preview, nil
+}
+
+// readPageMetadata collects the <title> and the <meta> tags of a page's
+// head, keyed by their property or name in lower case
+func readPageMetadata(r io.Reader) map[string]string {
+	meta := make(map[string]string)
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = true
+			case "body":
+				// Metadata lives in the head
+				return meta
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						if key == "" {
+							key = strings.ToLower(strings.TrimSpace(attr.Val))
+						}
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				// The first occurrence wins, as with browsers and crawlers
+				if _, seen := meta[key]; key != "" && key != "title" && content != "" && !seen {
+					meta[key] = content
+				}
+			}
+		case html.TextToken:
+			if inTitle && meta["title"] == "" {
+				meta["title"] = strings.Join(strings.Fields(string(tokenizer.Text())), " ")
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "title" {
+				inTitle = false
+			} else if string(name) == "head" {
+				return meta
+			}
+		}
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// truncateText shortens text to at most n characters, ending it with an
+// ellipsis when it was cut
+func truncateText(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
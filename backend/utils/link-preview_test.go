@@ -0,0 +1,371 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+)
+
+// servePage starts a local stand-in for a web site and points the link
+// preview client at it, counting the requests it gets
+func servePage(t *testing.T, contentType, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", contentType)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := LinkPreviewHTTPClient
+	LinkPreviewHTTPClient = server.Client()
+	t.Cleanup(func() { LinkPreviewHTTPClient = previous })
+	return server, &hits
+}
+
+func TestFetchLinkPreview(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want models.LinkPreview
+	}{
+		{
+			name: "opengraph",
+			head: `<title>Page title</title>
+				<meta property="og:title" content="OG title">
+				<meta property="og:description" content="OG description">
+				<meta property="og:site_name" content="Example">
+				<meta property="og:image" content="/images/cover.png">
+				<meta name="description" content="Plain description">`,
+			want: models.LinkPreview{
+				Title:       "OG title",
+				Description: "OG description",
+				SiteName:    "Example",
+				ImageURL:    "/images/cover.png",
+			},
+		},
+		{
+			name: "twitter card",
+			head: `<meta name="twitter:title" content="Card title">
+				<meta name="twitter:description" content="Card description">
+				<meta name="twitter:image" content="https://cdn.example.com/card.jpg">`,
+			want: models.LinkPreview{
+				Title:       "Card title",
+				Description: "Card description",
+				ImageURL:    "https://cdn.example.com/card.jpg",
+			},
+		},
+		{
+			name: "title and description fallback",
+			head: `<TITLE>
+					Plain   page
+				</TITLE>
+				<meta name="Description" content=" Plain description ">`,
+			want: models.LinkPreview{
+				Title:       "Plain page",
+				Description: "Plain description",
+			},
+		},
+		{
+			name: "first occurrence wins",
+			head: `<meta property="og:title" content="First">
+				<meta property="og:title" content="Second">`,
+			want: models.LinkPreview{Title: "First"},
+		},
+		{
+			name: "non-http image is dropped",
+			head: `<meta property="og:title" content="Title">
+				<meta property="og:image" content="javascript:alert(1)">`,
+			want: models.LinkPreview{Title: "Title"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := servePage(t, "text/html",
+				"<!doctype html><html><head>"+tt.head+"</head><body>"+
+					`<meta property="og:title" content="In the body"></body></html>`)
+
+			preview, err := FetchLinkPreview(context.Background(), server.URL+"/article")
+			if err != nil {
+				t.Fatalf("FetchLinkPreview: %v", err)
+			}
+
+			want := tt.want
+			want.URL = server.URL + "/article"
+			if strings.HasPrefix(want.ImageURL, "/") {
+				want.ImageURL = server.URL + want.ImageURL
+			}
+			if preview != want {
+				t.Fatalf("preview = %+v, want %+v", preview, want)
+			}
+		})
+	}
+}
+
+func TestFetchLinkPreviewRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"not html", "application/json", `{"title": "JSON"}`},
+		{"no metadata", "text/html", "<html><head></head><body>Hello</body></html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := servePage(t, tt.contentType, tt.body)
+			if _, err := FetchLinkPreview(context.Background(), server.URL); err == nil {
+				t.Fatal("FetchLinkPreview succeeded")
+			}
+		})
+	}
+}
+
+func TestFetchLinkPreviewReadsAtMostTheBodyLimit(t *testing.T) {
+	padding := "<!--" + strings.Repeat("x", linkPreviewMaxBody) + "-->"
+	server, _ := servePage(t, "text/html",
+		"<html><head>"+padding+`<meta property="og:title" content="Too late"></head></html>`)
+
+	if preview, err := FetchLinkPreview(context.Background(), server.URL); err == nil {
+		t.Fatalf("metadata past the body limit was read: %+v", preview)
+	}
+}
+
+func TestFetchLinkPreviewTruncates(t *testing.T) {
+	server, _ := servePage(t, "text/html", `<meta property="og:title" content="`+
+		strings.Repeat("é", linkPreviewMaxTitle+50)+`">`)
+
+	preview, err := FetchLinkPreview(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("FetchLinkPreview: %v", err)
+	}
+	if got := []rune(preview.Title); len(got) != linkPreviewMaxTitle || got[len(got)-1] != '…' {
+		t.Fatalf("title has %d characters, want %d ending in an ellipsis", len(got), linkPreviewMaxTitle)
+	}
+}
+
+func TestFetchLinkPreviewCharset(t *testing.T) {
+	// "Café Zoë" in ISO-8859-1
+	latin1 := "Caf\xe9 Zo\xeb"
+
+	tests := []struct {
+		name        string
+		contentType string
+		head        string
+	}{
+		{"content type header", "text/html; charset=iso-8859-1", ""},
+		{"meta charset", "text/html", `<meta charset="iso-8859-1">`},
+		{"meta http-equiv", "text/html",
+			`<meta http-equiv="Content-Type" content="text/html; charset=iso-8859-1">`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := servePage(t, tt.contentType,
+				"<html><head>"+tt.head+"<title>"+latin1+"</title></head></html>")
+
+			preview, err := FetchLinkPreview(context.Background(), server.URL)
+			if err != nil {
+				t.Fatalf("FetchLinkPreview: %v", err)
+			}
+			if preview.Title != "Café Zoë" {
+				t.Fatalf("title = %q, want %q", preview.Title, "Café Zoë")
+			}
+		})
+	}
+}
+
+func TestLinkPreviewForCaches(t *testing.T) {
+	databasetest.Open(t, &models.LinkPreview{})
+	server, hits := servePage(t, "text/html", `<meta property="og:title" content="Cached">`)
+	link := server.URL + "/cached"
+
+	first, err := LinkPreviewFor(context.Background(), link)
+	if err != nil || first.ID == 0 || first.Title != "Cached" {
+		t.Fatalf("LinkPreviewFor = %+v, %v", first, err)
+	}
+	second, err := LinkPreviewFor(context.Background(), link)
+	if err != nil || second.ID != first.ID {
+		t.Fatalf("LinkPreviewFor = %+v, %v", second, err)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("page fetched %d times, want once", hits.Load())
+	}
+
+	// Once stale, the page is fetched again and the same row updated
+	database.DB.Model(&models.LinkPreview{}).Where("id = ?", first.ID).
+		Update("fetched_at", time.Now().Add(-25*time.Hour))
+	third, err := LinkPreviewFor(context.Background(), link)
+	if err != nil || third.Title != "Cached" {
+		t.Fatalf("LinkPreviewFor = %+v, %v", third, err)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("stale preview not refetched, %d fetches", hits.Load())
+	}
+	var rows int64
+	database.DB.Model(&models.LinkPreview{}).Where("url = ?", link).Count(&rows)
+	if rows != 1 {
+		t.Fatalf("%d rows for the link, want 1", rows)
+	}
+}
+
+func TestLinkPreviewForRetriesFailuresSooner(t *testing.T) {
+	databasetest.Open(t, &models.LinkPreview{})
+	t.Setenv("LINK_PREVIEW_TTL", "24h")
+	server, hits := servePage(t, "text/plain", "not a page")
+	link := server.URL + "/broken"
+
+	preview, err := LinkPreviewFor(context.Background(), link)
+	if err != nil || !preview.Failed {
+		t.Fatalf("LinkPreviewFor = %+v, %v, want a cached failure", preview, err)
+	}
+	if _, err := LinkPreviewFor(context.Background(), link); err != nil || hits.Load() != 1 {
+		t.Fatalf("failure not cached: %v, %d fetches", err, hits.Load())
+	}
+
+	database.DB.Model(&models.LinkPreview{}).Where("url = ?", link).
+		Update("fetched_at", time.Now().Add(-2*time.Hour))
+	if _, err := LinkPreviewFor(context.Background(), link); err != nil || hits.Load() != 2 {
+		t.Fatalf("failure not retried after an hour: %v, %d fetches", err, hits.Load())
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b:1::1", false},
+		{"2002:a00:1::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := PublicAddress(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("PublicAddress(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}
+
+func TestPublicHTTPClientRefusesPrivateTargets(t *testing.T) {
+	// Serves on loopback, which must be refused like any internal service
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "internal")
+	}))
+	defer server.Close()
+
+	client := NewPublicHTTPClient(false)
+	targets := []string{
+		server.URL,
+		"http://localhost:" + server.URL[strings.LastIndex(server.URL, ":")+1:],
+		"http://10.0.0.1/",
+		"http://192.168.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+	}
+	for _, target := range targets {
+		if _, err := client.Get(target); !errors.Is(err, errBlockedAddress) {
+			t.Errorf("GET %s: error %v, want the address refused", target, err)
+		}
+	}
+
+	// IPv6 only where the system can create IPv6 sockets at all
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err == nil {
+		conn.Close()
+		for _, target := range []string{
+			"http://[::1]/",
+			"http://[fe80::1]/",
+			"http://[64:ff9b::a9fe:a9fe]/", // NAT64 of 169.254.169.254
+			"http://[2002:a9fe:a9fe::1]/",  // 6to4 of 169.254.169.254
+		} {
+			if _, err := client.Get(target); !errors.Is(err, errBlockedAddress) {
+				t.Errorf("GET %s: error %v, want the address refused", target, err)
+			}
+		}
+	}
+
+	if _, err := NewPublicHTTPClient(true).Get(server.URL); err != nil {
+		t.Errorf("GET with private addresses allowed: %v", err)
+	}
+}
+
+func TestPublicHTTPClientRefusesOtherPorts(t *testing.T) {
+	client := NewPublicHTTPClient(false, "80", "443")
+	for _, target := range []string{"http://93.184.215.14:25/", "http://93.184.215.14:6379/"} {
+		if _, err := client.Get(target); !errors.Is(err, errBlockedPort) {
+			t.Errorf("GET %s: error %v, want the port refused", target, err)
+		}
+	}
+}
+
+func TestGuardedHTTPClientChecksRedirects(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "internal")
+	}))
+	defer internal.Close()
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusFound)
+	}))
+	defer public.Close()
+
+	// Both listen on loopback; only the first server's port plays public
+	_, publicPort, _ := net.SplitHostPort(strings.TrimPrefix(public.URL, "http://"))
+	client := guardedHTTPClient(func(ip netip.Addr, port string) error {
+		if port != publicPort {
+			return errBlockedAddress
+		}
+		return nil
+	})
+
+	if _, err := client.Get(public.URL); !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("redirect to an internal address: error %v, want it refused", err)
+	}
+}
+
+func TestFirstURL(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"see https://example.com/a?b=c.", "https://example.com/a?b=c"},
+		{"(http://example.com/page)", "http://example.com/page"},
+		{"HTTPS://Example.com, then more", "HTTPS://Example.com"},
+		{"no links here", ""},
+		{"ftp://example.com/file", ""},
+	}
+
+	for _, tt := range tests {
+		if got := FirstURL(tt.text); got != tt.want {
+			t.Errorf("FirstURL(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
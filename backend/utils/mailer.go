@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email is a plain-text message sent by the app
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails such as verification links
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// AppMailer is the mailer selected by InitializeMailer
+var AppMailer Mailer
+
+// InitializeMailer creates the mailer named by MAIL_DRIVER: "smtp", "file"
+// or "log" (the default, so local runs need no mail server)
+func InitializeMailer() (Mailer, error) {
+	driver := os.Getenv("MAIL_DRIVER")
+	if driver == "" {
+		driver = "log"
+	}
+
+	var (
+		mailer Mailer
+		err    error
+	)
+	switch driver {
+	case "smtp":
+		mailer, err = NewSMTPMailer()
+	case "file":
+		mailer, err = NewFileMailer()
+	case "log":
+		mailer = LogMailer{}
+	default:
+		err = fmt.Errorf("unknown mail driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	AppMailer = mailer
+	log.Printf("Mailer initialized with the %s driver", driver)
+	return mailer, nil
+}
+
+// mailFrom is the sender address (MAIL_FROM)
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "no-reply@localhost"
+}
+
+// formatEmail renders the email as an RFC 5322 message
+func formatEmail(from string, email Email) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + email.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", email.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer sends through an SMTP server, upgrading to TLS when offered.
+//
+// Configuration: SMTP_HOST, SMTP_PORT (default 587), SMTP_USERNAME and
+// SMTP_PASSWORD (optional) and MAIL_FROM.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates the SMTP driver
+func NewSMTPMailer() (*SMTPMailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, fmt.Errorf("SMTP_HOST must be set for the smtp mail driver")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		auth: auth,
+		from: mailFrom(),
+	}, nil
+}
+
+// Send delivers the email
+func (m *SMTPMailer) Send(ctx context.Context, email Email) error {
+	if strings.ContainsAny(email.To, "\r\n") {
+		return fmt.Errorf("invalid recipient address")
+	}
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{email.To},
+		formatEmail(m.from, email)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// FileMailer writes every email as an .eml file into MAIL_FILE_DIR
+// (default ./tmp/mail), handy for inspecting mails during development
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer creates the file driver
+func NewFileMailer() (*FileMailer, error) {
+	dir := os.Getenv("MAIL_FILE_DIR")
+	if dir == "" {
+		dir = "./tmp/mail"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	return &FileMailer{dir: dir, from: mailFrom()}, nil
+}
+
+// Send writes the email to disk
+func (m *FileMailer) Send(ctx context.Context, email Email) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405"),
+		GenerateToken(6))
+	if err := os.WriteFile(filepath.Join(m.dir, name),
+		formatEmail(m.from, email), 0o644); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	return nil
+}
+
+// LogMailer prints emails to the server log instead of sending them
+type LogMailer struct{}
+
+// Send logs the email
+func (LogMailer) Send(ctx context.Context, email Email) error {
+	log.Printf("Email to %s\nSubject: %s\n\n%s\n", email.To, email.Subject, email.Body)
+	return nil
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chat-app/utils/oidctest"
+)
+
+const testRedirectURL = "http://app.test/api/auth/oidc/callback"
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *OIDCProvider) {
+	idp := oidctest.NewProvider(t, "chat-app")
+	return idp, &OIDCProvider{
+		Name:        "oidc",
+		Issuer:      idp.Issuer(),
+		ClientID:    "chat-app",
+		RedirectURL: testRedirectURL,
+		Scopes:      []string{"openid", "email", "profile"},
+		HTTPClient:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// signIn runs the browser part of the flow and returns the code, along with
+// the state, nonce and verifier the app used
+func signIn(t *testing.T, idp *oidctest.Provider, provider *OIDCProvider) (string, OIDCState) {
+	t.Helper()
+	state := OIDCState{
+		State:        GenerateToken(24),
+		Nonce:        GenerateToken(24),
+		CodeVerifier: GenerateToken(48),
+	}
+
+	authURL, err := provider.AuthCodeURL(context.Background(), state.State, state.Nonce,
+		PKCEChallenge(state.CodeVerifier))
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	callback, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if got := callback.Query().Get("state"); got != state.State {
+		t.Fatalf("state = %q, want %q", got, state.State)
+	}
+	return callback.Query().Get("code"), state
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	idp, provider := newTestProvider(t)
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "state", "nonce",
+		PKCEChallenge("verifier"))
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	if !strings.HasPrefix(authURL, idp.Issuer()+"/authorize?") {
+		t.Fatalf("authorization URL %q does not use the discovered endpoint", authURL)
+	}
+
+	u, _ := url.Parse(authURL)
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "chat-app",
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        PKCEChallenge("verifier"),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	code, state := signIn(t, idp, provider)
+
+	claims, err := provider.Exchange(context.Background(), code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	want := OIDCClaims{
+		Subject:       "subject-1",
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Name:          "Test User",
+	}
+	if claims != want {
+		t.Fatalf("claims = %+v, want %+v", claims, want)
+	}
+
+	// Codes are single use
+	if _, err := provider.Exchange(context.Background(), code, state.CodeVerifier,
+		state.Nonce); err == nil {
+		t.Fatal("Exchange accepted a code twice")
+	}
+}
+
+func TestOIDCExchangeRequiresPKCEVerifier(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	code, state := signIn(t, idp, provider)
+
+	if _, err := provider.Exchange(context.Background(), code, GenerateToken(48),
+		state.Nonce); err == nil {
+		t.Fatal("Exchange succeeded with the wrong code verifier")
+	}
+}
+
+func TestOIDCExchangeRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*oidctest.Provider)
+		wantErr string
+	}{
+		{
+			name:    "nonce mismatch",
+			setup:   func(idp *oidctest.Provider) { idp.TokenNonce = "replayed" },
+			wantErr: "nonce",
+		},
+		{
+			name:    "wrong audience",
+			setup:   func(idp *oidctest.Provider) { idp.TokenAudience = "another-client" },
+			wantErr: "aud",
+		},
+		{
+			name:    "wrong issuer",
+			setup:   func(idp *oidctest.Provider) { idp.TokenIssuer = "https://evil.example" },
+			wantErr: "iss",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp, provider := newTestProvider(t)
+			tt.setup(idp)
+			code, state := signIn(t, idp, provider)
+
+			_, err := provider.Exchange(context.Background(), code, state.CodeVerifier, state.Nonce)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Exchange error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	provider.Issuer = idp.Issuer() + "/tenant"
+
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce",
+		PKCEChallenge("verifier")); err == nil {
+		t.Fatal("AuthCodeURL accepted metadata for another issuer")
+	}
+}
+
+func TestOIDCStateToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	if _, err := InitializeTokenService(); err != nil {
+		t.Fatal(err)
+	}
+
+	state := OIDCState{State: "state", Nonce: "nonce", CodeVerifier: "verifier"}
+	token, err := CreateOIDCStateToken(state, time.Minute)
+	if err != nil {
+		t.Fatalf("CreateOIDCStateToken: %v", err)
+	}
+	got, err := ValidateOIDCStateToken(token)
+	if err != nil || got != state {
+		t.Fatalf("ValidateOIDCStateToken = %+v, %v", got, err)
+	}
+
+	// State tokens must not work as access tokens, nor the other way round
+	if _, err := ValidateToken(token); err == nil {
+		t.Fatal("state token accepted as an access token")
+	}
+	challenge, _ := CreateChallengeToken(1)
+	if _, err := ValidateOIDCStateToken(challenge); err == nil {
+		t.Fatal("challenge token accepted as login state")
+	}
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errBlockedAddress = errors.New("address is not publicly routable")
+
+// Address ranges that are not covered by the netip predicates but must not
+// be reachable either
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, may embed private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4, may embed private IPv4
+}
+
+var errBlockedPort = errors.New("port is not allowed")
+
+// NewPublicHTTPClient creates a client for requests to URLs chosen by users,
+// like link previews and bot webhooks. Unless allowPrivate is set, every
+// connection, including those made for redirects, is checked after DNS
+// resolution and refused when it would reach a non-public address, so DNS
+// tricks cannot reach internal services. When ports are given, connections
+// to any other port are refused as well.
+func NewPublicHTTPClient(allowPrivate bool, ports ...string) *http.Client {
+	return guardedHTTPClient(func(ip netip.Addr, port string) error {
+		if allowPrivate {
+			return nil
+		}
+		if !PublicAddress(ip) {
+			return errBlockedAddress
+		}
+		if len(ports) > 0 && !slices.Contains(ports, port) {
+			return errBlockedPort
+		}
+		return nil
+	})
+}
+
+// guardedHTTPClient creates a client that asks check before every
+// connection it opens
+func guardedHTTPClient(check func(ip netip.Addr, port string) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return errBlockedAddress
+			}
+			return check(ip, port)
+		},
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// No proxy, or the dialer would only ever see the proxy's address
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to a non-http URL")
+			}
+			return nil
+		},
+	}
+}
+
+// PublicAddress reports whether ip is a publicly routable unicast address
+func PublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// PublicHost reports whether a URL's host can be public. Literal addresses
+// must be public and localhost names are refused; other names are only
+// resolved, and checked, when connecting.
+func PublicHost(u *url.URL) bool {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return PublicAddress(ip)
+	}
+	return true
+}
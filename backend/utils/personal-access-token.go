@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"gorm.io/gorm"
+)
+
+// Personal access tokens start with this, so they are easy to tell apart
+// from JWTs and to spot when leaked
+const personalAccessTokenPrefix = "chat_pat_"
+
+// last_used_at is only written this often, not on every request
+const tokenUsageResolution = time.Minute
+
+var ErrPersonalAccessTokenInvalid = errors.New("access token is invalid, revoked or expired")
+
+// IsPersonalAccessToken reports whether a bearer token is a personal access
+// token rather than a JWT
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
+
+// IssuePersonalAccessToken creates a token for the user and returns it in
+// plain text. It cannot be recovered later.
+func IssuePersonalAccessToken(userID uint, name string, scopes []string,
+	expiresAt *time.Time) (string, models.PersonalAccessToken, error) {
+	token := personalAccessTokenPrefix + GenerateToken(32)
+
+	record := models.PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: HashToken(token),
+		Prefix:    token[:len(personalAccessTokenPrefix)+4],
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+	if err := database.DB.Create(&record).Error; err != nil {
+		return "", record, err
+	}
+	return token, record, nil
+}
+
+// AuthenticatePersonalAccessToken looks up an active token and records its use
+func AuthenticatePersonalAccessToken(token string) (models.PersonalAccessToken, error) {
+	var record models.PersonalAccessToken
+	err := database.DB.Where("token_hash = ?", HashToken(token)).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return record, ErrPersonalAccessTokenInvalid
+	}
+	if err != nil {
+		return record, err
+	}
+	if !record.Active() {
+		return record, ErrPersonalAccessTokenInvalid
+	}
+
+	now := time.Now()
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) > tokenUsageResolution {
+		if err := database.DB.Model(&record).Update("last_used_at", now).Error; err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+// RevokePersonalAccessTokens revokes every active token of the user
+func RevokePersonalAccessTokens(userID uint) error {
+	return database.DB.Model(&models.PersonalAccessToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// RemoteImageHTTPClient downloads images given by URL, like those posted to
+// incoming webhooks. When nil, a client that only connects to public
+// addresses on ports 80 and 443 is used; tests point it at a local stand-in.
+var RemoteImageHTTPClient *http.Client
+
+// The default client, created on first use. Setting
+// REMOTE_IMAGE_ALLOW_PRIVATE=true lifts its restrictions for local
+// development.
+var defaultRemoteImageClient = sync.OnceValue(func() *http.Client {
+	return NewPublicHTTPClient(GetEnvBool("REMOTE_IMAGE_ALLOW_PRIVATE", false), "80", "443")
+})
+
+// ErrImageDownload is returned when an image URL cannot be downloaded
+var ErrImageDownload = errors.New("image could not be downloaded")
+
+// DownloadImage fetches the file at a URL chosen by a user, reading no more
+// than an attachment may hold (ATTACHMENT_MAX_SIZE_MB). The content is not
+// checked; StoreImage refuses anything but a valid image.
+func DownloadImage(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: not an http or https URL", ErrImageDownload)
+	}
+
+	client := RemoteImageHTTPClient
+	if client == nil {
+		client = defaultRemoteImageClient()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImageDownload, err)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImageDownload, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrImageDownload, resp.StatusCode)
+	}
+
+	maxSize := LoadAttachmentLimits().MaxSize
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImageDownload, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrImageDownload, maxSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const RefreshCookieName = "refresh_token"
+
+// The refresh cookie is only sent to the auth endpoints
+const refreshCookiePath = "/api/auth"
+
+// A refresh token replayed within this window after its rotation is treated
+// as a race between two tabs refreshing at once rather than as theft
+const refreshReuseGrace = 30 * time.Second
+
+var (
+	ErrSessionInvalid     = errors.New("session is invalid or has expired")
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// AccessTokenTTL is the lifetime of access tokens (ACCESS_TOKEN_TTL, default 15m)
+func AccessTokenTTL() time.Duration {
+	return GetEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// RefreshTokenTTL is the lifetime of a session (REFRESH_TOKEN_TTL, default 30 days)
+func RefreshTokenTTL() time.Duration {
+	return GetEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// StartSession signs the user in on this device: it records a session, sets
+// the refresh cookie and issues an access token via CreateJWT
+func StartSession(c *fiber.Ctx, user models.User) (string, error) {
+	refreshToken := GenerateToken(32)
+
+	session := models.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: HashToken(refreshToken),
+		UserAgent:        c.Get(fiber.HeaderUserAgent),
+		IPAddress:        c.IP(),
+		LastUsedAt:       time.Now(),
+		ExpiresAt:        time.Now().Add(RefreshTokenTTL()),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		return "", err
+	}
+
+	setRefreshCookie(c, refreshToken, session.ExpiresAt)
+	return CreateJWT(c, user.ID, user.FullName, session.ID)
+}
+
+// RefreshSession rotates the refresh token from the cookie and issues a new
+// access token. Replaying an already rotated token revokes the session.
+func RefreshSession(c *fiber.Ctx) (string, error) {
+	refreshToken := c.Cookies(RefreshCookieName)
+	if refreshToken == "" {
+		return "", ErrSessionInvalid
+	}
+	tokenHash := HashToken(refreshToken)
+
+	var session models.Session
+	err := database.DB.Where("refresh_token_hash = ?", tokenHash).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", handleRefreshTokenReuse(tokenHash)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !session.Active() {
+		return "", ErrSessionInvalid
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, session.UserID).Error; err != nil {
+		return "", ErrSessionInvalid
+	}
+
+	newRefreshToken := GenerateToken(32)
+	now := time.Now()
+	// Only rotate if nobody else rotated the token in the meantime
+	result := database.DB.Model(&session).
+		Where("refresh_token_hash = ?", tokenHash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  HashToken(newRefreshToken),
+			"previous_token_hash": tokenHash,
+			"rotated_at":          now,
+			"last_used_at":        now,
+			"user_agent":          c.Get(fiber.HeaderUserAgent),
+			"ip_address":          c.IP(),
+		})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrSessionInvalid
+	}
+
+	setRefreshCookie(c, newRefreshToken, session.ExpiresAt)
+	return CreateJWT(c, user.ID, user.FullName, session.ID)
+}
+
+// handleRefreshTokenReuse deals with a refresh token that matches no current
+// session. If it is the predecessor of a session's token, someone is
+// replaying an old token and the whole session is revoked.
+func handleRefreshTokenReuse(tokenHash string) error {
+	var session models.Session
+	err := database.DB.Where("previous_token_hash = ?", tokenHash).First(&session).Error
+	if err != nil {
+		return ErrSessionInvalid
+	}
+
+	if session.RotatedAt != nil && time.Since(*session.RotatedAt) < refreshReuseGrace {
+		return ErrSessionInvalid
+	}
+
+	if err := RevokeSession(session.UserID, session.ID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// LoadActiveSession fetches a session and checks that it can still be used
+func LoadActiveSession(sessionID uint) (models.Session, error) {
+	var session models.Session
+	if err := database.DB.First(&session, sessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return session, ErrSessionInvalid
+		}
+		return session, err
+	}
+	if !session.Active() {
+		return session, ErrSessionInvalid
+	}
+	return session, nil
+}
+
+// SessionFromRefreshCookie finds the session behind the request's refresh
+// cookie, if any
+func SessionFromRefreshCookie(c *fiber.Ctx) (models.Session, error) {
+	var session models.Session
+	refreshToken := c.Cookies(RefreshCookieName)
+	if refreshToken == "" {
+		return session, ErrSessionInvalid
+	}
+	err := database.DB.Where("refresh_token_hash = ?", HashToken(refreshToken)).
+		First(&session).Error
+	if err != nil {
+		return session, ErrSessionInvalid
+	}
+	return session, nil
+}
+
+// RevokeSession revokes one of the user's sessions and drops its sockets
+func RevokeSession(userID, sessionID uint) error {
+	result := database.DB.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionInvalid
+	}
+
+	CloseSessionSockets(userID, sessionID)
+	return nil
+}
+
+// RevokeOtherSessions revokes every session of the user except keepSessionID
+// (pass 0 to revoke all of them)
+func RevokeOtherSessions(userID, keepSessionID uint) error {
+	var sessionIDs []uint
+	err := database.DB.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepSessionID).
+		Pluck("id", &sessionIDs).Error
+	if err != nil || len(sessionIDs) == 0 {
+		return err
+	}
+
+	if err := database.DB.Model(&models.Session{}).
+		Where("id IN ?", sessionIDs).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+
+	CloseSessionSockets(userID, sessionIDs...)
+	return nil
+}
+
+// ClearAuthCookies removes the access and refresh cookies
+func ClearAuthCookies(c *fiber.Ctx) {
+	// Determine cookie security based on environment
+	isProduction := os.Getenv("ENV_KEY") == "production"
+
+	for _, cookie := range []struct{ name, path string }{
+		{CookieName, "/"},
+		{RefreshCookieName, refreshCookiePath},
+	} {
+		c.Cookie(&fiber.Cookie{
+			Name:     cookie.name,
+			Value:    "",
+			Path:     cookie.path,
+			Expires:  time.Now().Add(-24 * time.Hour), // Expiry in the past clears the cookie
+			HTTPOnly: true,
+			Secure:   isProduction,
+			SameSite: fiber.CookieSameSiteStrictMode,
+		})
+	}
+}
+
+func setRefreshCookie(c *fiber.Ctx, refreshToken string, expiresAt time.Time) {
+	// Determine cookie security based on environment
+	isProduction := os.Getenv("ENV_KEY") == "production"
+
+	c.Cookie(&fiber.Cookie{
+		Name:     RefreshCookieName,
+		Value:    refreshToken,
+		Path:     refreshCookiePath,
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   isProduction,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// sessionApp signs a user in and refreshes their session, answering with
+// the error RefreshSession returned, if any
+func sessionApp(t *testing.T) (*fiber.App, models.User) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	if _, err := InitializeTokenService(); err != nil {
+		t.Fatal(err)
+	}
+	databasetest.Open(t, &models.User{}, &models.Session{})
+
+	user := models.User{Email: "user@example.com", FullName: "User", Password: "x"}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/login", func(c *fiber.Ctx) error {
+		_, err := StartSession(c, user)
+		return err
+	})
+	app.Post("/refresh", func(c *fiber.Ctx) error {
+		if _, err := RefreshSession(c); err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+		return nil
+	})
+	return app, user
+}
+
+// refreshCookie sends a request with the refresh token, if given, and
+// returns the status, the refresh token set in the response and the body
+func refreshCookie(t *testing.T, app *fiber.App, path, token string) (int, string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: RefreshCookieName, Value: token})
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == RefreshCookieName {
+			return resp.StatusCode, cookie.Value, string(body)
+		}
+	}
+	return resp.StatusCode, "", string(body)
+}
+
+func TestRefreshSessionRotatesToken(t *testing.T) {
+	app, _ := sessionApp(t)
+
+	_, first, _ := refreshCookie(t, app, "/login", "")
+	status, second, _ := refreshCookie(t, app, "/refresh", first)
+	if status != http.StatusOK || second == "" || second == first {
+		t.Fatalf("refresh: status %d, token %q", status, second)
+	}
+
+	// Two tabs refreshing at once: the loser is refused, the session lives
+	status, _, body := refreshCookie(t, app, "/refresh", first)
+	if status != http.StatusUnauthorized || body != ErrSessionInvalid.Error() {
+		t.Fatalf("replay within the grace period: status %d, %q", status, body)
+	}
+	if status, _, _ := refreshCookie(t, app, "/refresh", second); status != http.StatusOK {
+		t.Fatalf("current token refused after a racing refresh: status %d", status)
+	}
+}
+
+func TestRefreshSessionRevokesOnReuse(t *testing.T) {
+	app, user := sessionApp(t)
+
+	_, first, _ := refreshCookie(t, app, "/login", "")
+	_, second, _ := refreshCookie(t, app, "/refresh", first)
+
+	// Replayed well after the rotation, the old token gives the theft away
+	database.DB.Model(&models.Session{}).Where("user_id = ?", user.ID).
+		Update("rotated_at", time.Now().Add(-time.Minute))
+	status, _, body := refreshCookie(t, app, "/refresh", first)
+	if status != http.StatusUnauthorized || body != ErrRefreshTokenReused.Error() {
+		t.Fatalf("replay: status %d, %q", status, body)
+	}
+
+	var session models.Session
+	database.DB.Where("user_id = ?", user.ID).First(&session)
+	if session.Active() {
+		t.Fatal("session still active after refresh token reuse")
+	}
+	if _, err := LoadActiveSession(session.ID); !errors.Is(err, ErrSessionInvalid) {
+		t.Fatalf("LoadActiveSession = %v, want the session invalid", err)
+	}
+	if status, _, _ := refreshCookie(t, app, "/refresh", second); status != http.StatusUnauthorized {
+		t.Fatalf("current token still works after reuse: status %d", status)
+	}
+}
+
+func TestRefreshSessionRefusesUnknownToken(t *testing.T) {
+	app, _ := sessionApp(t)
+
+	for _, token := range []string{"", GenerateToken(32)} {
+		if status, _, _ := refreshCookie(t, app, "/refresh", token); status != http.StatusUnauthorized {
+			t.Fatalf("refresh with %q: status %d", token, status)
+		}
+	}
+}
@@ -1,22 +1,211 @@
 package utils
 
 import (
+	"encoding/json"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gofiber/websocket/v2"
 )
 
-// Map to store online users: {userId: websocket.Conn}
-var userSocketMap sync.Map // sync.Map for thread-safe access
+const (
+	// How long a single write to a client may block before it is dropped
+	socketWriteTimeout = 10 * time.Second
+	// Largest inbound frame accepted from a client
+	socketReadLimit = 64 * 1024
+)
+
+// socketClient is a single WebSocket connection (one browser tab or device).
+// The underlying connection supports only one concurrent writer, so every
+// write goes through the client's lock.
+type socketClient struct {
+	conn      *websocket.Conn
+	sessionId uint
+	mu        sync.Mutex
+}
+
+func (sc *socketClient) writeJSON(payload interface{}) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	return sc.conn.WriteJSON(payload)
+}
+
+// connectionRegistry keeps every open connection of every online user
+type connectionRegistry struct {
+	mu    sync.RWMutex
+	users map[uint]map[*socketClient]struct{}
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{users: make(map[uint]map[*socketClient]struct{})}
+}
+
+// add registers a connection and reports whether it is the user's first one
+func (r *connectionRegistry) add(userId uint, client *socketClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-// GetReceiverSocket retrieves the WebSocket connection for a given user ID
-func GetReceiverSocket(userId int) *websocket.Conn {
-	value, ok := userSocketMap.Load(userId)
-	if ok {
-		return value.(*websocket.Conn)
+	clients, ok := r.users[userId]
+	if !ok {
+		clients = make(map[*socketClient]struct{})
+		r.users[userId] = clients
+	}
+	clients[client] = struct{}{}
+	return !ok
+}
+
+// remove unregisters a connection and reports whether it was the user's last one
+func (r *connectionRegistry) remove(userId uint, client *socketClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, ok := r.users[userId]
+	if !ok {
+		return false
+	}
+	if _, ok := clients[client]; !ok {
+		return false
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(r.users, userId)
+		return true
+	}
+	return false
+}
+
+// clients returns a snapshot of the user's connections
+func (r *connectionRegistry) clients(userId uint) []*socketClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*socketClient, 0, len(r.users[userId]))
+	for client := range r.users[userId] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// onlineUsers returns the IDs of users with at least one open connection
+func (r *connectionRegistry) onlineUsers() []uint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	userIds := make([]uint, 0, len(r.users))
+	for userId := range r.users {
+		userIds = append(userIds, userId)
+	}
+	return userIds
+}
+
+// allClients returns a snapshot of every open connection
+func (r *connectionRegistry) allClients() []*socketClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*socketClient, 0, len(r.users))
+	for _, userClients := range r.users {
+		for client := range userClients {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Registry of online users: {userId: set of connections}
+var userSocketMap = newConnectionRegistry()
+
+// EmitToUser sends an event payload to every connection of the user and
+// returns how many connections it reached
+func EmitToUser(userId uint, payload interface{}) int {
+	delivered := 0
+	for _, client := range userSocketMap.clients(userId) {
+		if err := client.writeJSON(payload); err != nil {
+			log.Printf("Error sending WebSocket message to user %d: %v\n", userId, err)
+			// Closing makes the handler's read loop exit and unregister it
+			client.conn.Close()
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// EmitToUsers sends the same event payload to every listed user that is online
+func EmitToUsers(userIds []uint, payload interface{}) {
+	for _, userId := range userIds {
+		EmitToUser(userId, payload)
+	}
+}
+
+// CloseSessionSockets disconnects the user's connections that belong to
+// any of the given sessions, e.g. after they were revoked
+func CloseSessionSockets(userId uint, sessionIds ...uint) {
+	revoked := make(map[uint]bool, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		revoked[sessionId] = true
+	}
+
+	for _, client := range userSocketMap.clients(userId) {
+		if revoked[client.sessionId] {
+			client.conn.Close()
+		}
+	}
+}
+
+// IsUserOnline reports whether the user has at least one open connection
+func IsUserOnline(userId uint) bool {
+	return len(userSocketMap.clients(userId)) > 0
+}
+
+// SocketEventHandler handles an inbound client event for the authenticated
+// user. data is the raw JSON frame; a returned error is reported back to the
+// connection that sent the event.
+type SocketEventHandler func(userId uint, data []byte) error
+
+var (
+	socketEventHandlers = map[string]SocketEventHandler{}
+	socketConnectHooks  []func(userId uint)
+)
+
+// RegisterSocketEvent installs the handler for an inbound event name.
+// Handlers must be registered before the server starts accepting connections.
+func RegisterSocketEvent(event string, handler SocketEventHandler) {
+	socketEventHandlers[event] = handler
+}
+
+// OnSocketConnect registers a hook run whenever a user opens a connection.
+// Hooks must be registered before the server starts accepting connections.
+func OnSocketConnect(hook func(userId uint)) {
+	socketConnectHooks = append(socketConnectHooks, hook)
+}
+
+// dispatchSocketEvent routes an inbound frame to its registered handler
+func dispatchSocketEvent(client *socketClient, userId uint, data []byte) {
+	var frame struct {
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		log.Printf("Malformed WebSocket frame from user %d: %v\n", userId, err)
+		return
+	}
+
+	handler, ok := socketEventHandlers[frame.Event]
+	if !ok {
+		log.Printf("Unknown WebSocket event %q from user %d\n", frame.Event, userId)
+		return
+	}
+
+	if err := handler(userId, data); err != nil {
+		client.writeJSON(map[string]interface{}{
+			"event":   "error",
+			"source":  frame.Event,
+			"message": err.Error(),
+		})
 	}
-	return nil
 }
 
 // WebSocketHandler establishes a WebSocket connection and manages events
@@ -29,74 +218,76 @@ func WebSocketHandler(conn *websocket.Conn) {
 		return
 	}
 
-	// Validate the token (assuming ValidateToken is implemented)
-	claims, err := ValidateToken(token)
+	// Same check as for HTTP requests; tokens of revoked sessions must
+	// not open new connections
+	userId, session, err := AuthenticateAccessToken(token)
 	if err != nil {
-		log.Printf("Invalid token: %v", err)
+		log.Printf("Rejected WebSocket: %v", err)
 		return
 	}
+	sessionId := session.ID
 
-	// Extract user ID from token claims
-	userIdFloat, ok := claims["id"].(float64)
-	if !ok {
-		log.Println("Invalid user ID in token claims")
-		return
-	}
-	userId := int(userIdFloat)
-
-	// Store the connection in the userSocketMap
-	userSocketMap.Store(userId, conn)
+	// Register the connection alongside any other open tabs or devices
+	client := &socketClient{conn: conn, sessionId: sessionId}
+	firstConnection := userSocketMap.add(userId, client)
 	log.Printf("User connected: %s, UserID: %d\n", conn.RemoteAddr(),
 		userId)
 
-	// Broadcast updated list of online users
-	broadcastOnlineUsers()
+	if firstConnection {
+		// Broadcast updated list of online users
+		broadcastOnlineUsers()
+	} else {
+		// Nothing changed for the others, but the new tab needs the list
+		sendOnlineUsers(client, userSocketMap.onlineUsers())
+	}
 
-	// Keep reading messages from the WebSocket
+	for _, hook := range socketConnectHooks {
+		go hook(userId)
+	}
+
+	// Keep reading client events from the WebSocket
+	conn.SetReadLimit(socketReadLimit)
 	for {
-		_, _, err := conn.ReadMessage()
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("WebSocket read error for user %d: %v\n", userId, err)
 			break
 		}
+		if messageType == websocket.TextMessage {
+			dispatchSocketEvent(client, userId, data)
+		}
 	}
 
-	// Remove the user from the map when disconnected
-	userSocketMap.Delete(userId)
+	// Remove the connection from the registry when disconnected
+	lastConnection := userSocketMap.remove(userId, client)
 	log.Printf("User disconnected: %s, UserID: %d\n", conn.RemoteAddr(), userId)
 
-	// Broadcast updated list of online users
-	broadcastOnlineUsers()
+	// The user only goes offline when their last connection closes
+	if lastConnection {
+		typingIndicators.stopAll(userId)
+		broadcastOnlineUsers()
+	}
 }
 
 // broadcastOnlineUsers broadcasts the list of online users to all connected clients
 func broadcastOnlineUsers() {
-	onlineUsers := make([]int, 0)
-
-	// Collect all user IDs
-	userSocketMap.Range(func(key, value interface{}) bool {
-		userId := key.(int)
-		onlineUsers = append(onlineUsers, userId)
-		return true
-	})
+	onlineUsers := userSocketMap.onlineUsers()
 
 	// Use goroutines for broadcasting to avoid blocking
-	userSocketMap.Range(func(key, value interface{}) bool {
-		go func(conn *websocket.Conn) {
-			err := conn.WriteJSON(map[string]interface{}{
-				"event":       "getOnlineUsers",
-				"onlineUsers": onlineUsers,
-			})
-			if err != nil {
-				log.Printf("Error broadcasting online users to user %d: %v\n", key, err)
-				userSocketMap.Delete(key) // Remove stale connection
-			}
-		}(value.(*websocket.Conn))
-		return true
-	})
+	for _, client := range userSocketMap.allClients() {
+		go sendOnlineUsers(client, onlineUsers)
+	}
 }
 
-// RemoveReceiverSocket removes a WebSocket connection for a given user ID
-func RemoveReceiverSocket(userId int) {
-	userSocketMap.Delete(userId)
+// sendOnlineUsers sends the list of online users to a single connection
+func sendOnlineUsers(client *socketClient, onlineUsers []uint) {
+	err := client.writeJSON(map[string]interface{}{
+		"event":       "getOnlineUsers",
+		"onlineUsers": onlineUsers,
+	})
+	if err != nil {
+		log.Printf("Error broadcasting online users to %s: %v\n",
+			client.conn.RemoteAddr(), err)
+		client.conn.Close() // Drop stale connection
+	}
 }
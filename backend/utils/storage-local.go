@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Route prefix the local driver serves files under
+const localMediaPrefix = "/media/"
+
+// LocalStorage keeps media on the local filesystem and serves it through
+// Fiber. URLs carry an HMAC of the key, /media/<signature>/<key>, so files
+// can only be fetched through links the app handed out.
+//
+// Configuration: STORAGE_LOCAL_DIR (default ./uploads), STORAGE_PUBLIC_URL
+// (origin prepended to media URLs, e.g. http://localhost:3000; relative URLs
+// when empty) and STORAGE_SIGNING_KEY (defaults to JWT_SECRET).
+type LocalStorage struct {
+	dir        string
+	publicURL  string
+	signingKey []byte
+}
+
+// NewLocalStorage creates the local filesystem driver
+func NewLocalStorage() (*LocalStorage, error) {
+	dir := os.Getenv("STORAGE_LOCAL_DIR")
+	if dir == "" {
+		dir = "./uploads"
+	}
+
+	signingKey := os.Getenv("STORAGE_SIGNING_KEY")
+	if signingKey == "" {
+		signingKey = os.Getenv("JWT_SECRET")
+	}
+	if signingKey == "" {
+		return nil, errors.New("STORAGE_SIGNING_KEY or JWT_SECRET must be set for local storage")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &LocalStorage{
+		dir:        dir,
+		publicURL:  strings.TrimSuffix(os.Getenv("STORAGE_PUBLIC_URL"), "/"),
+		signingKey: []byte(signingKey),
+	}, nil
+}
+
+// Put writes the file to disk
+func (ls *LocalStorage) Put(ctx context.Context, key, contentType string,
+	data []byte) (string, error) {
+	filePath, err := ls.pathForKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	// Write to a temporary file first so readers never see partial files
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to store file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to store file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to store file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return "", fmt.Errorf("failed to store file: %w", err)
+	}
+
+	return ls.publicURL + localMediaPrefix + ls.sign(key) + "/" + key, nil
+}
+
+// Open opens the file on disk
+func (ls *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	filePath, err := ls.pathForKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return file, nil
+}
+
+// Delete removes the file from disk
+func (ls *LocalStorage) Delete(ctx context.Context, key string) error {
+	filePath, err := ls.pathForKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+// KeyFromURL extracts the key from a media URL, checking its signature
+func (ls *LocalStorage) KeyFromURL(url string) string {
+	i := strings.Index(url, localMediaPrefix)
+	if i < 0 || !strings.HasPrefix(url, ls.publicURL) {
+		return ""
+	}
+
+	signature, key, ok := strings.Cut(url[i+len(localMediaPrefix):], "/")
+	if !ok || !ls.verify(key, signature) {
+		return ""
+	}
+	return key
+}
+
+// Serve is the Fiber handler for /media/:signature/*
+func (ls *LocalStorage) Serve(c *fiber.Ctx) error {
+	key := c.Params("*")
+	if !ls.verify(key, c.Params("signature")) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	filePath, err := ls.pathForKey(key)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	// Keys are random and never reused, so the content never changes
+	c.Set(fiber.HeaderCacheControl, "private, max-age=31536000, immutable")
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	return c.SendFile(filePath)
+}
+
+// Route is the path pattern Serve has to be mounted on
+func (ls *LocalStorage) Route() string {
+	return localMediaPrefix + ":signature/*"
+}
+
+// pathForKey maps a key to a path inside the storage directory, refusing
+// anything that would escape it
+func (ls *LocalStorage) pathForKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned != "/"+key {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(ls.dir, filepath.FromSlash(cleaned)), nil
+}
+
+func (ls *LocalStorage) sign(key string) string {
+	mac := hmac.New(sha256.New, ls.signingKey)
+	mac.Write([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (ls *LocalStorage) verify(key, signature string) bool {
+	return hmac.Equal([]byte(ls.sign(key)), []byte(signature))
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Storage keeps uploaded media (profile pictures, chat images) and hands
+// back the URL clients load it from. Keys are slash separated paths such as
+// "messages/3f2a….png".
+type Storage interface {
+	// Put stores data under key and returns its public URL
+	Put(ctx context.Context, key, contentType string, data []byte) (string, error)
+	// Open streams the object stored under key; the caller closes it
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+	// KeyFromURL recovers the key of a URL returned by Put, or "" when the
+	// URL does not belong to this backend
+	KeyFromURL(url string) string
+}
+
+// MediaStorage is the backend selected by InitializeStorage
+var MediaStorage Storage
+
+// InitializeStorage creates the storage backend named by STORAGE_DRIVER:
+// "cloudinary", "local" or "s3". When unset, Cloudinary is used if it is
+// configured and the local filesystem otherwise, so the app runs offline.
+func InitializeStorage() (Storage, error) {
+	driver := os.Getenv("STORAGE_DRIVER")
+	if driver == "" {
+		driver = "local"
+		if os.Getenv("CLOUD_NAME") != "" {
+			driver = "cloudinary"
+		}
+	}
+
+	var (
+		storage Storage
+		err     error
+	)
+	switch driver {
+	case "cloudinary":
+		storage, err = NewCloudinaryService()
+	case "local":
+		storage, err = NewLocalStorage()
+	case "s3":
+		storage, err = NewS3Storage()
+	default:
+		err = fmt.Errorf("unknown storage driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	MediaStorage = storage
+	log.Printf("Media storage initialized with the %s driver", driver)
+	return storage, nil
+}
+
+// NewStorageKey builds a unique key inside folder with the given extension
+// (including the dot, may be empty)
+func NewStorageKey(folder, ext string) string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	return strings.Trim(folder, "/") + "/" + hex.EncodeToString(buf) + ext
+}
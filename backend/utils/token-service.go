@@ -0,0 +1,369 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var errTokenServiceUninitialized = errors.New("token service is not initialized")
+
+// TokenService signs and verifies every JWT the app issues: access tokens,
+// login challenges and single sign-on state.
+//
+// Access tokens carry the issuer (JWT_ISSUER, default "chat-app") and the
+// audience (JWT_AUDIENCE, default the issuer), which are checked on every
+// request and which other services verifying tokens through the JWKS should
+// check as well.
+//
+// Internal tokens (login challenges, single sign-on state) are only ever
+// read by this server. They are signed with HS256 and a key that is never
+// published: JWT_INTERNAL_SECRET, or one derived from JWT_SECRET. With
+// neither set a random key is used, so these tokens do not survive a restart
+// and are not shared between instances.
+//
+// With JWT_SIGNING_KEY_FILE set, tokens are signed with that PEM private key
+// (RSA for RS256, Ed25519 for EdDSA) and carry its kid. Retired keys listed
+// in JWT_VERIFICATION_KEY_FILES (comma separated PEM public keys) are still
+// accepted, so keys can be rotated without signing everyone out. Key IDs are
+// RFC 7638 thumbprints, so they need no configuration.
+//
+// Without a signing key, tokens are signed with HS256 and JWT_SECRET. When
+// a signing key is configured, HS256 tokens are still accepted while
+// JWT_SECRET is set, unless JWT_ACCEPT_HS256 is false.
+type TokenService struct {
+	signingKID    string
+	signingMethod jwt.SigningMethod
+	signingKey    interface{}
+
+	verificationKeys map[string]verificationKey
+	hmacSecret       []byte
+
+	issuer         string
+	audience       string
+	internalSecret []byte
+}
+
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+// AuthTokens is the token service set up by InitializeTokenService
+var AuthTokens *TokenService
+
+// InitializeTokenService loads the signing and verification keys
+func InitializeTokenService() (*TokenService, error) {
+	service := &TokenService{verificationKeys: map[string]verificationKey{}}
+	secret := os.Getenv("JWT_SECRET")
+
+	service.issuer = os.Getenv("JWT_ISSUER")
+	if service.issuer == "" {
+		service.issuer = "chat-app"
+	}
+	service.audience = os.Getenv("JWT_AUDIENCE")
+	if service.audience == "" {
+		service.audience = service.issuer
+	}
+	service.internalSecret = internalTokenSecret(secret)
+
+	keyFile := os.Getenv("JWT_SIGNING_KEY_FILE")
+	if keyFile == "" {
+		if secret == "" {
+			return nil, errors.New("JWT_SIGNING_KEY_FILE or JWT_SECRET must be set")
+		}
+		service.signingMethod = jwt.SigningMethodHS256
+		service.signingKey = []byte(secret)
+		service.hmacSecret = []byte(secret)
+		AuthTokens = service
+		log.Println("Token service initialized with HS256")
+		return service, nil
+	}
+
+	privateKey, err := readPrivateKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	method, publicKey, err := signingMethodFor(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := keyThumbprint(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	service.signingKID = kid
+	service.signingMethod = method
+	service.signingKey = privateKey
+	service.verificationKeys[kid] = verificationKey{method: method, key: publicKey}
+
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEY_FILES"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		publicKey, err := readPublicKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		method, publicKey, err := signingMethodFor(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		kid, err := keyThumbprint(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		service.verificationKeys[kid] = verificationKey{method: method, key: publicKey}
+	}
+
+	if secret != "" && GetEnvBool("JWT_ACCEPT_HS256", true) {
+		service.hmacSecret = []byte(secret)
+	}
+
+	AuthTokens = service
+	log.Printf("Token service initialized with %s (kid %s, %d verification keys)",
+		method.Alg(), kid, len(service.verificationKeys))
+	return service, nil
+}
+
+// Sign signs access token claims with the current signing key, adding the
+// issuer and audience
+func (s *TokenService) Sign(claims jwt.MapClaims) (string, error) {
+	if s == nil {
+		return "", errTokenServiceUninitialized
+	}
+
+	claims["iss"] = s.issuer
+	claims["aud"] = s.audience
+	token := jwt.NewWithClaims(s.signingMethod, claims)
+	if s.signingKID != "" {
+		token.Header["kid"] = s.signingKID
+	}
+	return token.SignedString(s.signingKey)
+}
+
+// Parse verifies an access token's signature, expiry, issuer and audience
+// and returns its claims
+func (s *TokenService) Parse(tokenString string) (jwt.MapClaims, error) {
+	if s == nil {
+		return nil, errTokenServiceUninitialized
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method == jwt.SigningMethodHS256 {
+			if s.hmacSecret == nil {
+				return nil, errors.New("HS256 tokens are not accepted")
+			}
+			return s.hmacSecret, nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.verificationKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		// The algorithm must be the key's, never whatever the token claims
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.key, nil
+	},
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(s.audience),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// SignInternal signs the claims of a token only this server reads with the
+// unpublished internal key
+func (s *TokenService) SignInternal(claims jwt.MapClaims) (string, error) {
+	if s == nil {
+		return "", errTokenServiceUninitialized
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.internalSecret)
+}
+
+// ParseInternal verifies a token made by SignInternal and returns its claims
+func (s *TokenService) ParseInternal(tokenString string) (jwt.MapClaims, error) {
+	if s == nil {
+		return nil, errTokenServiceUninitialized
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return s.internalSecret, nil
+	},
+		jwt.WithValidMethods([]string{"HS256"}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// internalTokenSecret picks the key internal tokens are signed with. A key
+// derived from JWT_SECRET differs from it, so internal tokens never verify
+// as HS256 access tokens.
+func internalTokenSecret(secret string) []byte {
+	if internal := os.Getenv("JWT_INTERNAL_SECRET"); internal != "" {
+		return []byte(internal)
+	}
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("chat-app internal tokens"))
+		return mac.Sum(nil)
+	}
+
+	log.Println("JWT_INTERNAL_SECRET is not set; login challenges will not survive a restart")
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// JWKS returns the public keys tokens are verified with as a JSON Web Key
+// Set, so other services can verify tokens on their own. HS256 secrets are
+// never published.
+func (s *TokenService) JWKS() map[string]interface{} {
+	keys := []map[string]string{}
+	if s != nil {
+		for kid, key := range s.verificationKeys {
+			jwk, err := publicJWK(key.key)
+			if err != nil {
+				continue
+			}
+			jwk["kid"] = kid
+			jwk["alg"] = key.method.Alg()
+			jwk["use"] = "sig"
+			keys = append(keys, jwk)
+		}
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// signingMethodFor picks the JWT algorithm for a public key
+func signingMethodFor(publicKey crypto.PublicKey) (jwt.SigningMethod, crypto.PublicKey, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, nil, errors.New("RSA signing keys must have at least 2048 bits")
+		}
+		return jwt.SigningMethodRS256, key, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, key, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported signing key type %T", publicKey)
+}
+
+// publicJWK returns the required JWK members of a public key
+func publicJWK(publicKey crypto.PublicKey) (map[string]string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   encode(key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   encode(key),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", publicKey)
+}
+
+// keyThumbprint computes the RFC 7638 thumbprint used as key ID
+func keyThumbprint(publicKey crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(publicKey)
+	if err != nil {
+		return "", err
+	}
+	// encoding/json sorts map keys, which gives the canonical form
+	canonical, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// readPrivateKeyFile reads a PKCS#8 or PKCS#1 (RSA) PEM private key
+func readPrivateKeyFile(path string) (crypto.Signer, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", path)
+	}
+	return signer, nil
+}
+
+// readPublicKeyFile reads a PEM public key or certificate
+func readPublicKeyFile(path string) (crypto.PublicKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %s: %w", path, err)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func readPEMFile(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeSigningKey writes a new Ed25519 key pair as PEM files and returns
+// their paths
+func writeSigningKey(t *testing.T, name string) (privatePath, publicPath string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	publicDER, _ := x509.MarshalPKIXPublicKey(publicKey)
+
+	dir := t.TempDir()
+	privatePath = filepath.Join(dir, name+".pem")
+	publicPath = filepath.Join(dir, name+".pub.pem")
+	write := func(path, blockType string, der []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(privatePath, "PRIVATE KEY", privateDER)
+	write(publicPath, "PUBLIC KEY", publicDER)
+	return privatePath, publicPath
+}
+
+// tokenService initializes a service from the given environment, which
+// replaces every JWT setting
+func tokenService(t *testing.T, env map[string]string) *TokenService {
+	t.Helper()
+	for _, key := range []string{"JWT_SECRET", "JWT_SIGNING_KEY_FILE", "JWT_VERIFICATION_KEY_FILES",
+		"JWT_ACCEPT_HS256", "JWT_ISSUER", "JWT_AUDIENCE", "JWT_INTERNAL_SECRET"} {
+		t.Setenv(key, env[key])
+	}
+	service, err := InitializeTokenService()
+	if err != nil {
+		t.Fatalf("InitializeTokenService: %v", err)
+	}
+	return service
+}
+
+func accessClaims() jwt.MapClaims {
+	return jwt.MapClaims{"typ": tokenTypeAccess, "id": 1,
+		"exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func sign(t *testing.T, service *TokenService, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := service.Sign(claims)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return token
+}
+
+func TestTokenServiceKeyRotation(t *testing.T) {
+	oldKey, oldPublic := writeSigningKey(t, "old")
+	newKey, _ := writeSigningKey(t, "new")
+
+	before := tokenService(t, map[string]string{"JWT_SIGNING_KEY_FILE": oldKey})
+	issued := sign(t, before, accessClaims())
+
+	// The retired key still verifies the tokens it signed
+	rotated := tokenService(t, map[string]string{
+		"JWT_SIGNING_KEY_FILE":       newKey,
+		"JWT_VERIFICATION_KEY_FILES": oldPublic,
+	})
+	if _, err := rotated.Parse(issued); err != nil {
+		t.Fatalf("token signed with the retired key refused: %v", err)
+	}
+	if _, err := rotated.Parse(sign(t, rotated, accessClaims())); err != nil {
+		t.Fatalf("token signed with the new key refused: %v", err)
+	}
+	if keys := rotated.JWKS()["keys"].([]map[string]string); len(keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want both", len(keys))
+	}
+
+	// Once it is dropped, so are its tokens
+	dropped := tokenService(t, map[string]string{"JWT_SIGNING_KEY_FILE": newKey})
+	if _, err := dropped.Parse(issued); err == nil {
+		t.Fatal("token signed with a dropped key accepted")
+	}
+}
+
+func TestTokenServiceJWKS(t *testing.T) {
+	key, _ := writeSigningKey(t, "current")
+	service := tokenService(t, map[string]string{
+		"JWT_SIGNING_KEY_FILE": key,
+		"JWT_SECRET":           "shared-secret",
+	})
+
+	keys := service.JWKS()["keys"].([]map[string]string)
+	if len(keys) != 1 {
+		t.Fatalf("JWKS = %v, want only the public key", keys)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(sign(t, service, accessClaims()), jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0]["kid"] != token.Header["kid"] || keys[0]["alg"] != "EdDSA" || keys[0]["d"] != "" {
+		t.Fatalf("JWKS key %v does not match the token header %v", keys[0], token.Header)
+	}
+}
+
+func TestTokenServiceHS256Fallback(t *testing.T) {
+	key, _ := writeSigningKey(t, "current")
+	hs256 := sign(t, tokenService(t, map[string]string{"JWT_SECRET": "shared-secret"}), accessClaims())
+
+	accepting := tokenService(t, map[string]string{
+		"JWT_SIGNING_KEY_FILE": key,
+		"JWT_SECRET":           "shared-secret",
+	})
+	if _, err := accepting.Parse(hs256); err != nil {
+		t.Fatalf("HS256 token refused while JWT_SECRET is set: %v", err)
+	}
+
+	refusing := tokenService(t, map[string]string{
+		"JWT_SIGNING_KEY_FILE": key,
+		"JWT_SECRET":           "shared-secret",
+		"JWT_ACCEPT_HS256":     "false",
+	})
+	if _, err := refusing.Parse(hs256); err == nil {
+		t.Fatal("HS256 token accepted with JWT_ACCEPT_HS256=false")
+	}
+}
+
+func TestTokenServiceRequiresIssuerAndAudience(t *testing.T) {
+	service := tokenService(t, map[string]string{"JWT_SECRET": "shared-secret"})
+
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"another issuer", map[string]string{"JWT_SECRET": "shared-secret", "JWT_ISSUER": "other-app"}},
+		{"another audience", map[string]string{"JWT_SECRET": "shared-secret", "JWT_AUDIENCE": "other-api"}},
+	}
+	for _, tt := range tests {
+		token := sign(t, tokenService(t, tt.env), accessClaims())
+		if _, err := service.Parse(token); err == nil {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+
+	// Without iss and aud, e.g. signed before they were added
+	bare, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims()).
+		SignedString([]byte("shared-secret"))
+	if _, err := service.Parse(bare); err == nil {
+		t.Error("token without issuer and audience accepted")
+	}
+
+	noExpiry := accessClaims()
+	delete(noExpiry, "exp")
+	if _, err := service.Parse(sign(t, service, noExpiry)); err == nil {
+		t.Error("token without expiry accepted")
+	}
+}
+
+func TestTokenServiceKeepsInternalTokensApart(t *testing.T) {
+	service := tokenService(t, map[string]string{"JWT_SECRET": "shared-secret"})
+
+	internal, err := service.SignInternal(accessClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Parse(internal); err == nil {
+		t.Error("internal token accepted as an access token")
+	}
+	if _, err := service.ParseInternal(sign(t, service, accessClaims())); err == nil {
+		t.Error("access token accepted as an internal token")
+	}
+	if _, err := service.ParseInternal(internal); err != nil {
+		t.Errorf("internal token refused: %v", err)
+	}
+
+	// Other instances sharing JWT_SECRET derive the same internal key
+	other := tokenService(t, map[string]string{"JWT_SECRET": "shared-secret"})
+	if _, err := other.ParseInternal(internal); err != nil {
+		t.Errorf("internal token refused by another instance: %v", err)
+	}
+}
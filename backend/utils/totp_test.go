@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 secret of the RFC 6238 test vectors, base32 encoded
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	tests := []struct {
+		unix     int64
+		code     string
+		wantStep int64
+	}{
+		// RFC 6238 appendix B, truncated to six digits
+		{59, "287082", 1},
+		{1111111109, "081804", 37037036},
+		{1234567890, "005924", 41152263},
+		{2000000000, "279037", 66666666},
+	}
+
+	for _, tt := range tests {
+		step, ok := ValidateTOTP(rfcTOTPSecret, tt.code, time.Unix(tt.unix, 0))
+		if !ok || step != tt.wantStep {
+			t.Errorf("ValidateTOTP(%q at %d) = %d, %v, want step %d", tt.code, tt.unix,
+				step, ok, tt.wantStep)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	issued := time.Unix(1234567890, 0)
+
+	// One step either way is tolerated for clock drift, no more
+	for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		if _, ok := ValidateTOTP(rfcTOTPSecret, "005924", issued.Add(offset)); !ok {
+			t.Errorf("code refused %v from when it was issued", offset)
+		}
+	}
+	for _, offset := range []time.Duration{-90 * time.Second, 90 * time.Second} {
+		if _, ok := ValidateTOTP(rfcTOTPSecret, "005924", issued.Add(offset)); ok {
+			t.Errorf("code accepted %v from when it was issued", offset)
+		}
+	}
+}
+
+func TestValidateTOTPRefusesMalformed(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	tests := []struct {
+		secret string
+		code   string
+	}{
+		{rfcTOTPSecret, "05924"},
+		{rfcTOTPSecret, "0005924"},
+		{rfcTOTPSecret, ""},
+		{"not base32!", "005924"},
+	}
+
+	for _, tt := range tests {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, now); ok {
+			t.Errorf("ValidateTOTP(%q, %q) accepted", tt.secret, tt.code)
+		}
+	}
+
+	// Secrets are accepted in lower case, as some apps display them
+	if _, ok := ValidateTOTP(strings.ToLower(rfcTOTPSecret), "005924", now); !ok {
+		t.Error("lower case secret refused")
+	}
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// Minimum gap between two "typing" events relayed for the same pair,
+	// however often the client sends them
+	typingThrottle = 2 * time.Second
+	// A typing state that is not refreshed within this window expires and
+	// the peer receives "stopTyping", e.g. when the client disappears
+	typingTimeout = 6 * time.Second
+)
+
+type typingKey struct {
+	from uint
+	to   uint
+}
+
+type typingState struct {
+	lastRelayed time.Time
+	timer       *time.Timer
+}
+
+// typingTracker holds who is currently typing to whom
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+var typingIndicators = &typingTracker{active: make(map[typingKey]*typingState)}
+
+// start records that from is typing to the peer and relays it unless a
+// "typing" event for the pair went out within the throttle window
+func (t *typingTracker) start(from, to uint) {
+	key := typingKey{from: from, to: to}
+	now := time.Now()
+
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if ok {
+		state.timer.Reset(typingTimeout)
+		if now.Sub(state.lastRelayed) < typingThrottle {
+			t.mu.Unlock()
+			return
+		}
+		state.lastRelayed = now
+	} else {
+		state = &typingState{lastRelayed: now}
+		state.timer = time.AfterFunc(typingTimeout, func() {
+			t.expire(key, state)
+		})
+		t.active[key] = state
+	}
+	t.mu.Unlock()
+
+	relayTyping("typing", from, to)
+}
+
+// stop clears the typing state of the pair and tells the peer
+func (t *typingTracker) stop(from, to uint) {
+	key := typingKey{from: from, to: to}
+
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if ok {
+		state.timer.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+
+	if ok {
+		relayTyping("stopTyping", from, to)
+	}
+}
+
+// expire runs when a typing state was not refreshed in time
+func (t *typingTracker) expire(key typingKey, state *typingState) {
+	t.mu.Lock()
+	current, ok := t.active[key]
+	if !ok || current != state {
+		// Stopped or restarted in the meantime
+		t.mu.Unlock()
+		return
+	}
+	delete(t.active, key)
+	t.mu.Unlock()
+
+	relayTyping("stopTyping", key.from, key.to)
+}
+
+// stopAll clears every typing state of a user, e.g. once they go offline
+func (t *typingTracker) stopAll(from uint) {
+	var peers []uint
+
+	t.mu.Lock()
+	for key, state := range t.active {
+		if key.from == from {
+			state.timer.Stop()
+			delete(t.active, key)
+			peers = append(peers, key.to)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, to := range peers {
+		relayTyping("stopTyping", from, to)
+	}
+}
+
+func relayTyping(event string, from, to uint) {
+	EmitToUser(to, map[string]interface{}{
+		"event":  event,
+		"userId": from,
+	})
+}
+
+var errInvalidTypingPeer = errors.New("a valid peerId is required")
+
+// parseTypingPeer reads the peer of a typing event: {"event": ..., "peerId": 5}
+func parseTypingPeer(userId uint, data []byte) (uint, error) {
+	var event struct {
+		PeerID uint `json:"peerId"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil ||
+		event.PeerID == 0 || event.PeerID == userId {
+		return 0, errInvalidTypingPeer
+	}
+	return event.PeerID, nil
+}
+
+// TypingSocketEvent handles the "typing" client event
+func TypingSocketEvent(userId uint, data []byte) error {
+	peerId, err := parseTypingPeer(userId, data)
+	if err != nil {
+		return err
+	}
+	typingIndicators.start(userId, peerId)
+	return nil
+}
+
+// StopTypingSocketEvent handles the "stopTyping" client event
+func StopTypingSocketEvent(userId uint, data []byte) error {
+	peerId, err := parseTypingPeer(userId, data)
+	if err != nil {
+		return err
+	}
+	typingIndicators.stop(userId, peerId)
+	return nil
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// DecodeDataURI decodes a base64 data URI such as the frontend sends for
+// chat images ("data:image/png;base64,....") into its bytes and content type
+func DecodeDataURI(uri string) ([]byte, string, error) {
+	header, payload, ok := strings.Cut(uri, ",")
+	if !ok || !strings.HasPrefix(header, "data:") ||
+		!strings.HasSuffix(header, ";base64") {
+		return nil, "", errors.New("expected a base64 data URI")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, "", errors.New("invalid base64 payload")
+	}
+
+	contentType := strings.TrimSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
+
+// ReadFormFile reads an uploaded multipart file into memory together with
+// the content type declared by the client
+func ReadFormFile(fileHeader *multipart.FileHeader) ([]byte, string, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := fileHeader.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
+
+// ExtensionForContentType returns a file extension (with the dot) for a
+// content type, or "" when none is known
+func ExtensionForContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	// Prefer the common extensions over whatever the system table lists first
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "audio/ogg":
+		return ".ogg"
+	case "audio/webm":
+		return ".webm"
+	case "audio/wav":
+		return ".wav"
+	}
+
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
+
+// IsImage reports whether data looks like an image, judged by its content
+// rather than by what the client claimed
+func IsImage(data []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(data), "image/")
+}
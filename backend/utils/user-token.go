@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"gorm.io/gorm"
+)
+
+var ErrUserTokenInvalid = errors.New("token is invalid or has expired")
+
+// IssueUserToken creates a single-use token for the user. Earlier unused
+// tokens with the same purpose stop working.
+func IssueUserToken(userID uint, purpose string, ttl time.Duration) (string, error) {
+	token := GenerateToken(32)
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.UserToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: HashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeUserToken marks a token as used inside tx and returns it. It fails
+// with ErrUserTokenInvalid if the token is unknown, used, expired or was
+// issued for another purpose.
+func ConsumeUserToken(tx *gorm.DB, token, purpose string) (models.UserToken, error) {
+	var userToken models.UserToken
+	err := tx.Where("token_hash = ? AND purpose = ?", HashToken(token), purpose).
+		First(&userToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return userToken, ErrUserTokenInvalid
+	}
+	if err != nil {
+		return userToken, err
+	}
+	if userToken.UsedAt != nil || time.Now().After(userToken.ExpiresAt) {
+		return userToken, ErrUserTokenInvalid
+	}
+
+	// The condition on used_at keeps two concurrent requests from both
+	// consuming the token
+	now := time.Now()
+	result := tx.Model(&userToken).Where("used_at IS NULL").Update("used_at", now)
+	if result.Error != nil {
+		return userToken, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return userToken, ErrUserTokenInvalid
+	}
+	userToken.UsedAt = &now
+	return userToken, nil
+}
+
+// LatestUserToken returns the most recently issued token of a purpose
+func LatestUserToken(userID uint, purpose string) (models.UserToken, error) {
+	var userToken models.UserToken
+	err := database.DB.Where("user_id = ? AND purpose = ?", userID, purpose).
+		Order("created_at DESC").First(&userToken).Error
+	return userToken, err
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/database/databasetest"
+	"github.com/chat-app/models"
+)
+
+func consume(token, purpose string) error {
+	_, err := ConsumeUserToken(database.DB, token, purpose)
+	return err
+}
+
+func TestUserTokenSingleUse(t *testing.T) {
+	databasetest.Open(t, &models.UserToken{})
+
+	token, err := IssueUserToken(1, models.TokenPurposeEmailVerification, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := ConsumeUserToken(database.DB, token, models.TokenPurposeEmailVerification)
+	if err != nil || userToken.UserID != 1 {
+		t.Fatalf("ConsumeUserToken = %+v, %v", userToken, err)
+	}
+	if err := consume(token, models.TokenPurposeEmailVerification); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Fatalf("second use: %v, want ErrUserTokenInvalid", err)
+	}
+}
+
+func TestUserTokenRefused(t *testing.T) {
+	databasetest.Open(t, &models.UserToken{})
+
+	superseded, _ := IssueUserToken(1, models.TokenPurposeEmailVerification, time.Hour)
+	current, _ := IssueUserToken(1, models.TokenPurposeEmailVerification, time.Hour)
+	expired, _ := IssueUserToken(2, models.TokenPurposeEmailVerification, -time.Second)
+	reset, _ := IssueUserToken(3, models.TokenPurposePasswordReset, time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"superseded by a newer token", superseded},
+		{"expired", expired},
+		{"issued for another purpose", reset},
+		{"unknown", GenerateToken(32)},
+	}
+	for _, tt := range tests {
+		if err := consume(tt.token, models.TokenPurposeEmailVerification); !errors.Is(err, ErrUserTokenInvalid) {
+			t.Errorf("%s: %v, want ErrUserTokenInvalid", tt.name, err)
+		}
+	}
+
+	if err := consume(current, models.TokenPurposeEmailVerification); err != nil {
+		t.Fatalf("newest token refused: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chat-app/database"
+	"github.com/chat-app/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Headers of a webhook delivery. The signature is the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret, so receivers can
+// reject forged and replayed requests.
+const (
+	WebhookEventHeader     = "X-Chat-Event"
+	WebhookDeliveryHeader  = "X-Chat-Delivery"
+	WebhookTimestampHeader = "X-Chat-Timestamp"
+	WebhookSignatureHeader = "X-Chat-Signature"
+)
+
+// WebhookEventMessageCreated is sent when someone messages a bot
+const WebhookEventMessageCreated = "message.created"
+
+// How many deliveries the worker claims at once
+const webhookBatchSize = 20
+
+// A claimed delivery is not picked up again for this long, in case the
+// worker dies while sending it
+const webhookClaimLease = 2 * time.Minute
+
+// WebhookHTTPClient sends the deliveries. When nil, a client that refuses
+// private, loopback and link-local addresses is used, so bots cannot be
+// pointed at internal services; tests point it at a local receiver.
+var WebhookHTTPClient *http.Client
+
+// The default client, created on first use. WEBHOOK_ALLOW_PRIVATE=true
+// lifts the address restrictions, for bots running next to the server.
+var defaultWebhookClient = sync.OnceValue(func() *http.Client {
+	return NewPublicHTTPClient(webhookAllowPrivate())
+})
+
+func webhookAllowPrivate() bool {
+	return GetEnvBool("WEBHOOK_ALLOW_PRIVATE", false)
+}
+
+// Wakes the worker when new deliveries are queued
+var webhookWakeup = make(chan struct{}, 1)
+
+// webhookMaxAttempts is how often a delivery is tried before it is marked
+// failed (WEBHOOK_MAX_ATTEMPTS, default 6)
+func webhookMaxAttempts() int {
+	return GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 6)
+}
+
+// webhookRetryDelay is the wait after the given failed attempt: 30s, 1m,
+// 2m, ... up to an hour
+func webhookRetryDelay(attempt int) time.Duration {
+	delay := GetEnvDuration("WEBHOOK_RETRY_BASE", 30*time.Second)
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
+
+// SignWebhookPayload computes the signature header value for a delivery
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateWebhookURL accepts absolute http(s) URLs whose host is not a
+// private address. Names are checked again on every delivery, once resolved.
+func ValidateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook URL must be an absolute http or https URL")
+	}
+	if !webhookAllowPrivate() && !PublicHost(u) {
+		return errors.New("webhook URL must point to a public address")
+	}
+	return nil
+}
+
+// EnqueueBotDeliveries queues the message for the webhooks of every bot
+// among the recipients. Messages sent by bots are not delivered to other
+// bots, so two bots cannot keep answering each other.
+func EnqueueBotDeliveries(message models.Message, sender models.User, recipients []uint) {
+	if sender.Type == models.UserTypeBot || len(recipients) == 0 {
+		return
+	}
+
+	var webhooks []models.BotWebhook
+	err := database.DB.
+		Joins("JOIN users ON users.id = bot_webhooks.bot_id").
+		Where("bot_webhooks.bot_id IN ? AND bot_webhooks.active = ? AND users.type = ?",
+			recipients, true, models.UserTypeBot).
+		Find(&webhooks).Error
+	if err != nil {
+		log.Println("Error fetching bot webhooks:", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	deliveries := make([]models.WebhookDelivery, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		body, err := json.Marshal(map[string]interface{}{
+			"event":   WebhookEventMessageCreated,
+			"botId":   webhook.BotID,
+			"message": message,
+			"sender": map[string]interface{}{
+				"id":         sender.ID,
+				"fullname":   sender.FullName,
+				"profilePic": sender.ProfilePic,
+			},
+		})
+		if err != nil {
+			log.Println("Error encoding webhook payload:", err)
+			continue
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			Event:         WebhookEventMessageCreated,
+			Payload:       string(body),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+		})
+	}
+
+	if err := database.DB.Create(&deliveries).Error; err != nil {
+		log.Println("Error queueing webhook deliveries:", err)
+		return
+	}
+
+	select {
+	case webhookWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// StartWebhookWorker sends queued deliveries in the background until ctx
+// is done. Deliveries are claimed with SKIP LOCKED, so several server
+// instances can run a worker each.
+func StartWebhookWorker(ctx context.Context) {
+	interval := GetEnvDuration("WEBHOOK_POLL_INTERVAL", 5*time.Second)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			// Keep going while there is a backlog
+			for processWebhookBatch(ctx) == webhookBatchSize {
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-webhookWakeup:
+			}
+		}
+	}()
+}
+
+// processWebhookBatch claims due deliveries and attempts them, returning
+// how many were claimed
+func processWebhookBatch(ctx context.Context) int {
+	var deliveries []models.WebhookDelivery
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, time.Now()).
+			Order("next_attempt_at ASC").Limit(webhookBatchSize).
+			Find(&deliveries).Error; err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(deliveries))
+		for i, delivery := range deliveries {
+			ids[i] = delivery.ID
+		}
+		return tx.Model(&models.WebhookDelivery{}).Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(webhookClaimLease)).Error
+	})
+	if err != nil {
+		log.Println("Error claiming webhook deliveries:", err)
+		return 0
+	}
+
+	for _, delivery := range deliveries {
+		attemptWebhookDelivery(ctx, delivery)
+	}
+	return len(deliveries)
+}
+
+// attemptWebhookDelivery sends one delivery and records the outcome
+func attemptWebhookDelivery(ctx context.Context, delivery models.WebhookDelivery) {
+	var webhook models.BotWebhook
+	if err := database.DB.First(&webhook, delivery.WebhookID).Error; err != nil ||
+		!webhook.Active {
+		database.DB.Model(&delivery).Updates(map[string]interface{}{
+			"status":          models.DeliveryFailed,
+			"last_error":      "webhook was removed or disabled",
+			"next_attempt_at": nil,
+		})
+		return
+	}
+
+	statusCode, sendErr := sendWebhook(ctx, webhook, delivery)
+
+	attempts := delivery.Attempts + 1
+	updates := map[string]interface{}{
+		"attempts":         attempts,
+		"last_status_code": statusCode,
+		"last_error":       "",
+	}
+	switch {
+	case sendErr == nil:
+		updates["status"] = models.DeliverySucceeded
+		updates["delivered_at"] = time.Now()
+		updates["next_attempt_at"] = nil
+	case attempts >= webhookMaxAttempts():
+		updates["status"] = models.DeliveryFailed
+		updates["last_error"] = sendErr.Error()
+		updates["next_attempt_at"] = nil
+	default:
+		updates["last_error"] = sendErr.Error()
+		updates["next_attempt_at"] = time.Now().Add(webhookRetryDelay(attempts))
+	}
+
+	if err := database.DB.Model(&delivery).Updates(updates).Error; err != nil {
+		log.Println("Error recording webhook delivery:", err)
+	}
+}
+
+// sendWebhook posts the signed payload. Any 2xx response counts as success.
+func sendWebhook(ctx context.Context, webhook models.BotWebhook,
+	delivery models.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-app-webhooks/1.0")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, timestamp, body))
+
+	client := WebhookHTTPClient
+	if client == nil {
+		client = defaultWebhookClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "testing"
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://bots.example.com/hook", true},
+		{"http://93.184.215.14:8080/hook", true},
+		{"ftp://bots.example.com/hook", false},
+		{"/relative/hook", false},
+		{"http://localhost:5432/", false},
+		{"http://api.localhost/", false},
+		{"http://127.0.0.1/", false},
+		{"http://10.0.0.5/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::1]:8080/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+		{"http://[64:ff9b::a00:1]/", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateWebhookURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("ValidateWebhookURL(%q) = %v, want valid %v", tt.url, err, tt.valid)
+		}
+	}
+
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	if err := ValidateWebhookURL("http://localhost:3000/hook"); err != nil {
+		t.Errorf("private URL refused with WEBHOOK_ALLOW_PRIVATE: %v", err)
+	}
+}
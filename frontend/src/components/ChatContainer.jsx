@@ -66,8 +66,8 @@ const ChatContainer = () => {
                 <img
                   src={
                     message.senderId === authUser.id
-                      ? authUser.profilePic || "/avatar.png"
-                      : selectedUser.profilePic || "/avatar.png"
+                      ? authUser.profilePicThumbnail || authUser.profilePic || "/avatar.png"
+                      : selectedUser.profilePicThumbnail || selectedUser.profilePic || "/avatar.png"
                   }
                   alt="profile pic"
                 />
@@ -81,7 +81,7 @@ const ChatContainer = () => {
             <div className="chat-bubble flex flex-col">
               {message.image && (
                 <img
-                  src={message.image}
+                  src={message.imageThumbnail || message.image}
                   alt="Attachment"
                   className="sm:max-w-[200px] rounded-md mb-2"
                 />
@@ -14,7 +14,7 @@ const ChatHeader = () => {
           <div className="avatar">
             <div className="size-10 rounded-full relative">
               <img
-                src={selectedUser.profilePic || "/avatar.png"}
+                src={selectedUser.profilePicThumbnail || selectedUser.profilePic || "/avatar.png"}
                 alt={selectedUser.fullName}
               />
             </div>
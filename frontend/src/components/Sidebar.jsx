@@ -62,7 +62,7 @@ const Sidebar = () => {
           >
             <div className="relative mx-auto lg:mx-0">
               <img
-                src={user?.profilePic || "/avatar.png"}
+                src={user?.profilePicThumbnail || user?.profilePic || "/avatar.png"}
                 alt={user.name}
                 className="size-12 object-cover rounded-full"
               />
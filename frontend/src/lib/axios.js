@@ -7,3 +7,33 @@ export const axiosInstance = axios.create({
       : "/api",
   withCredentials: true,
 });
+
+// Access tokens are short-lived: on a 401, rotate the session with the
+// refresh cookie once and retry the original request
+let refreshPromise = null;
+
+axiosInstance.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const request = error.config;
+    const skipRefresh =
+      !request ||
+      request._retried ||
+      ["/auth/refresh", "/auth/login", "/auth/logout"].includes(request.url);
+
+    if (error.response?.status !== 401 || skipRefresh) {
+      return Promise.reject(error);
+    }
+
+    request._retried = true;
+    try {
+      refreshPromise ??= axiosInstance.post("/auth/refresh");
+      await refreshPromise;
+    } catch {
+      return Promise.reject(error);
+    } finally {
+      refreshPromise = null;
+    }
+    return axiosInstance(request);
+  }
+);